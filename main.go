@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"substack-to-kindle/pkg/cleaner"
 	"substack-to-kindle/pkg/converter"
+	"substack-to-kindle/pkg/httpclient"
+	"substack-to-kindle/pkg/imapwatch"
 	"substack-to-kindle/pkg/pdfconverter"
 	"substack-to-kindle/pkg/scraper"
 	"substack-to-kindle/pkg/sender"
+	"substack-to-kindle/pkg/smtpserver"
 
 	"github.com/joho/godotenv"
 )
@@ -26,6 +34,37 @@ func main() {
 
 	// Parse command line arguments
 	urlFlag := flag.String("url", "", "URL of the Substack article to convert")
+	feedFlag := flag.String("feed", "", "URL of a Substack publication whose latest posts should be converted")
+	archiveFlag := flag.String("archive", "", "URL of a Substack publication whose archive should be converted")
+	limitFlag := flag.Int("limit", 0, "Maximum number of posts to convert in feed or archive mode (default: 5 for feeds, all for archives)")
+	sortFlag := flag.String("sort", "new", "Archive order: new or top")
+	bundleFlag := flag.Bool("bundle", false, "Send the posts of a feed, archive or mailbox as one book, with links between them kept inside the book")
+	sinceFlag := flag.String("since", "", "Only convert archive posts published on or after this date (YYYY-MM-DD)")
+	untilFlag := flag.String("until", "", "Only convert archive posts published on or before this date (YYYY-MM-DD)")
+	commentsFlag := flag.Bool("comments", false, "Append the post's comment thread as a separate chapter")
+	commentsSortFlag := flag.String("comments-sort", "top", "Comment order: top or new")
+	commentsDepthFlag := flag.Int("comments-depth", 3, "Maximum depth of comment replies (0 for no limit)")
+	commentsLimitFlag := flag.Int("comments-limit", 100, "Maximum number of comments to include (0 for no limit)")
+	imageWidthFlag := flag.Int("image-width", scraper.DefaultImageWidth, "Preferred image width in pixels, e.g. 1264 for a Kindle Paperwhite")
+	rulesFlag := flag.String("rules", "", "Path to a file with extra CSS selectors to remove from articles, one per line")
+	sendPreviewsFlag := flag.Bool("send-previews", false, "Send the free preview of paywalled posts with a notice instead of refusing them")
+	timezoneFlag := flag.String("timezone", "", "Time zone for dates in the ebook, e.g. Local or Europe/Berlin (default: the publication's)")
+	localeFlag := flag.String("locale", "en", "Language for dates and labels in the ebook: en, de, fr, es, it, pt, nl or sv")
+	highlightFlag := flag.Bool("highlight", false, "Add syntax highlighting to code blocks with a known language")
+	mathImagesFlag := flag.Bool("math-images", false, "Send formulas to latex.codecogs.com to show them as images in AZW3 and MOBI files, instead of as TeX")
+	timeoutFlag := flag.Duration("timeout", httpclient.DefaultOptions().Timeout, "Timeout for each HTTP request attempt")
+	retriesFlag := flag.Int("retries", httpclient.DefaultOptions().MaxRetries, "Number of retries for failed HTTP requests")
+	rateFlag := flag.Float64("rate", httpclient.DefaultOptions().RequestsPerSecond, "Maximum HTTP requests per second to each host (0 for no limit)")
+	userAgentFlag := flag.String("user-agent", httpclient.DefaultUserAgent, "User-Agent sent with HTTP requests")
+	proxyFlag := flag.String("proxy", "", "Proxy URL for HTTP requests (default: HTTP_PROXY and HTTPS_PROXY)")
+	offlineFlag := flag.Bool("offline", false, "Only use pages and images from the cache, without network access")
+	noCacheFlag := flag.Bool("no-cache", false, "Do not cache pages and images on disk")
+	emailFlag := flag.String("email", "", "Path to an .eml file or mbox archive of newsletter emails to convert")
+	watchIMAPFlag := flag.Bool("watch-imap", false, "Watch the IMAP folder configured in .env and send new newsletters from allowed senders as they arrive")
+	watchIntervalFlag := flag.Duration("watch-interval", 5*time.Minute, "Time between checks of the IMAP folder")
+	serveSMTPFlag := flag.Bool("serve-smtp", false, "Receive forwarded newsletters over SMTP from allowed senders and send them to Kindle")
+	smtpAddrFlag := flag.String("smtp-addr", "", "Address the SMTP receiver listens on (default: SMTP_SERVER_ADDR or 127.0.0.1:2525)")
+	htmlFlag := flag.String("html", "", "Path to a saved HTML, MHTML or SingleFile page to convert without downloading it")
 	pdfFlag := flag.String("pdf", "", "Path to a local PDF file to convert")
 	format := flag.String("format", "epub", "Output format: epub, azw3, or mobi")
 	skipCalibre := flag.Bool("skip-calibre", true, "Skip using Calibre even if it's available (default: true)")
@@ -45,10 +84,320 @@ func main() {
 		log.Println("Warning: MOBI format is no longer supported by Amazon's Send to Kindle service. Consider using EPUB or AZW3 instead.")
 	}
 
+	// Configure the HTTP client shared by all requests
+	httpOptions := httpclient.DefaultOptions()
+	httpOptions.Timeout = *timeoutFlag
+	httpOptions.MaxRetries = *retriesFlag
+	httpOptions.RequestsPerSecond = *rateFlag
+	httpOptions.UserAgent = *userAgentFlag
+	httpOptions.ProxyURL = *proxyFlag
+	httpOptions.Offline = *offlineFlag
+	if *noCacheFlag {
+		if *offlineFlag {
+			log.Fatal("-offline needs the cache, so it cannot be combined with -no-cache")
+		}
+		httpOptions.CacheDir = ""
+	}
+	if err := scraper.UseHTTPOptions(httpOptions); err != nil {
+		log.Fatalf("Failed to configure HTTP client: %v", err)
+	}
+
+	// Use a Substack session for subscriber-only posts, if configured
+	if err := scraper.UseSession(scraper.LoadSessionConfigFromEnv()); err != nil {
+		log.Fatalf("Failed to load Substack session: %v", err)
+	}
+
+	if err := scraper.UseImageWidth(*imageWidthFlag); err != nil {
+		log.Fatalf("Invalid image width: %v", err)
+	}
+
+	// Strip Substack's widgets, plus anything the user asks for
+	cleanOptions := cleaner.DefaultOptions()
+	if *rulesFlag != "" {
+		rules, err := cleaner.LoadRules(*rulesFlag)
+		if err != nil {
+			log.Fatalf("Failed to load cleanup rules: %v", err)
+		}
+		cleanOptions.Remove = append(cleanOptions.Remove, rules...)
+	}
+
+	convertOptions := converter.DefaultOptions()
+	convertOptions.HighlightCode = *highlightFlag
+	convertOptions.RenderMathImages = *mathImagesFlag
+	convertOptions.AllowPreview = *sendPreviewsFlag
+	if *timezoneFlag != "" {
+		location, err := time.LoadLocation(*timezoneFlag)
+		if err != nil {
+			log.Fatalf("Invalid time zone: %v", err)
+		}
+		convertOptions.TimeZone = location
+	}
+	if !converter.SupportedLocale(*localeFlag) {
+		log.Fatalf("Unsupported locale: %s", *localeFlag)
+	}
+	convertOptions.Locale = *localeFlag
+
+	ctx := context.Background()
 	var result *converter.ConversionResult
 
-	// Check if PDF file is provided
-	if *pdfFlag != "" {
+	// Only load comments when asked for
+	var commentOptions *scraper.CommentOptions
+	if *commentsFlag {
+		if *commentsSortFlag != "top" && *commentsSortFlag != "new" {
+			log.Fatal("Comment order must be either 'top' or 'new'")
+		}
+		commentOptions = scraper.DefaultCommentOptions()
+		commentOptions.Sort = *commentsSortFlag
+		commentOptions.MaxDepth = *commentsDepthFlag
+		commentOptions.MaxCount = *commentsLimitFlag
+	}
+
+	// Check if a publication feed is provided
+	if *feedFlag != "" {
+		// Process publication feed
+		fmt.Println("Reading feed of:", *feedFlag)
+		limit := *limitFlag
+		if limit <= 0 {
+			limit = 5
+		}
+		articles, err := scraper.ScrapeFeed(ctx, *feedFlag, limit)
+		if err != nil {
+			log.Fatalf("Failed to read feed: %v", err)
+		}
+		if len(articles) == 0 {
+			log.Fatal("The feed does not contain any posts")
+		}
+		fmt.Printf("Found %d posts\n", len(articles))
+
+		config := sender.LoadEmailConfigFromEnv()
+		if *bundleFlag {
+			for _, article := range articles {
+				fmt.Printf("Processing: %s by %s\n", article.Title, article.Author)
+				addComments(ctx, article, commentOptions)
+			}
+			if err := sendBundle(ctx, *titleFlag, articles, *format, cleanOptions, convertOptions, config); err != nil {
+				log.Fatalf("Failed to send bundle: %v", err)
+			}
+			return
+		}
+
+		failed := 0
+		for _, article := range articles {
+			fmt.Printf("Processing: %s by %s\n", article.Title, article.Author)
+			addComments(ctx, article, commentOptions)
+			if err := convertAndSend(ctx, article, *format, cleanOptions, convertOptions, config); err != nil {
+				log.Printf("Warning: Failed to process %q: %v", article.Title, err)
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			log.Fatalf("%d of %d posts could not be sent", failed, len(articles))
+		}
+		fmt.Printf("Successfully sent %d posts to Kindle!\n", len(articles))
+		return
+	} else if *archiveFlag != "" {
+		// Process publication archive
+		options := scraper.DefaultArchiveOptions()
+		options.Sort = *sortFlag
+		options.MaxPosts = *limitFlag
+		if *sinceFlag != "" {
+			since, err := time.ParseInLocation("2006-01-02", *sinceFlag, time.Local)
+			if err != nil {
+				log.Fatalf("Invalid -since date: %v", err)
+			}
+			options.Since = since
+		}
+		if *untilFlag != "" {
+			until, err := time.ParseInLocation("2006-01-02", *untilFlag, time.Local)
+			if err != nil {
+				log.Fatalf("Invalid -until date: %v", err)
+			}
+			// Include the whole final day
+			options.Until = until.AddDate(0, 0, 1)
+		}
+
+		fmt.Println("Crawling archive of:", *archiveFlag)
+		config := sender.LoadEmailConfigFromEnv()
+		sent, failed := 0, 0
+		var bundled []*scraper.Article
+		err := scraper.CrawlArchive(ctx, *archiveFlag, options, func(post scraper.ArchivePost) error {
+			fmt.Printf("Processing: %s (%s)\n", post.Title, post.PostDate.Format("January 2, 2006"))
+			article, err := scraper.ScrapeSubstack(ctx, post.CanonicalURL)
+			if err == nil {
+				addComments(ctx, article, commentOptions)
+				if *bundleFlag {
+					// Sent together once the crawl is done
+					bundled = append(bundled, article)
+				} else {
+					err = convertAndSend(ctx, article, *format, cleanOptions, convertOptions, config)
+				}
+			}
+			if err != nil {
+				log.Printf("Warning: Failed to process %q: %v", post.Title, err)
+				failed++
+				return nil
+			}
+			sent++
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to crawl archive: %v", err)
+		}
+
+		if sent+failed == 0 {
+			log.Fatal("No archive posts matched the requested range")
+		}
+		if *bundleFlag {
+			if len(bundled) > 0 {
+				if err := sendBundle(ctx, *titleFlag, bundled, *format, cleanOptions, convertOptions, config); err != nil {
+					log.Fatalf("Failed to send bundle: %v", err)
+				}
+			}
+			if failed > 0 {
+				log.Fatalf("%d of %d posts could not be read", failed, sent+failed)
+			}
+			return
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d posts could not be sent", failed, sent+failed)
+		}
+		fmt.Printf("Successfully sent %d posts to Kindle!\n", sent)
+		return
+	} else if *htmlFlag != "" {
+		// Process a page saved from the browser, without network access
+		if *commentsFlag {
+			log.Fatal("-comments needs network access, so it cannot be combined with -html")
+		}
+		if *mathImagesFlag {
+			log.Fatal("-math-images needs network access, so it cannot be combined with -html")
+		}
+		fmt.Println("Reading saved page:", *htmlFlag)
+		article, err := scraper.ScrapeFile(*htmlFlag)
+		if err != nil {
+			log.Fatalf("Failed to read saved page: %v", err)
+		}
+		fmt.Printf("Successfully read article: %s by %s\n", article.Title, article.Author)
+
+		// Images the browser did not save would have to be downloaded
+		dropped, err := scraper.DropRemoteImages(article)
+		if err != nil {
+			log.Fatalf("Failed to read saved page: %v", err)
+		}
+		for _, imageURL := range dropped {
+			log.Printf("Warning: Leaving out an image that was not saved with the page: %s", imageURL)
+		}
+
+		result, err = convertArticle(ctx, article, *format, cleanOptions, convertOptions)
+		if err != nil {
+			log.Fatalf("Failed to convert article: %v", err)
+		}
+	} else if *emailFlag != "" {
+		// Process newsletters received by email
+		fmt.Println("Reading emails from:", *emailFlag)
+		config := sender.LoadEmailConfigFromEnv()
+		sent, failed := 0, 0
+		var bundled []*scraper.Article
+		err := scraper.ScrapeEmails(*emailFlag, func(article *scraper.Article, err error) error {
+			if err == nil {
+				fmt.Printf("Processing: %s by %s\n", article.Title, article.Author)
+				if *bundleFlag {
+					// Sent together once all messages are read
+					bundled = append(bundled, article)
+				} else {
+					err = convertAndSend(ctx, article, *format, cleanOptions, convertOptions, config)
+				}
+			}
+			if err != nil {
+				log.Printf("Warning: Failed to process email: %v", err)
+				failed++
+				return nil
+			}
+			sent++
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to read emails: %v", err)
+		}
+
+		if sent+failed == 0 {
+			log.Fatal("No emails found")
+		}
+		if *bundleFlag {
+			if len(bundled) > 0 {
+				if err := sendBundle(ctx, *titleFlag, bundled, *format, cleanOptions, convertOptions, config); err != nil {
+					log.Fatalf("Failed to send bundle: %v", err)
+				}
+			}
+			if failed > 0 {
+				log.Fatalf("%d of %d emails could not be read", failed, sent+failed)
+			}
+			return
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d emails could not be sent", failed, sent+failed)
+		}
+		fmt.Printf("Successfully sent %d posts to Kindle!\n", sent)
+		return
+	} else if *watchIMAPFlag {
+		// Process newsletters as they arrive in the mailbox
+		imapConfig := imapwatch.LoadConfigFromEnv()
+		imapConfig.Interval = *watchIntervalFlag
+		config := sender.LoadEmailConfigFromEnv()
+		watcher, err := imapwatch.New(imapConfig, func(ctx context.Context, message []byte) error {
+			article, err := scraper.ScrapeEmail(message)
+			if err != nil {
+				return fmt.Errorf("failed to read email: %w", err)
+			}
+			fmt.Printf("Processing: %s by %s\n", article.Title, article.Author)
+			return convertAndSend(ctx, article, *format, cleanOptions, convertOptions, config)
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure IMAP: %v", err)
+		}
+
+		// Stop cleanly on Ctrl+C
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		fmt.Printf("Watching %s on %s every %s...\n", imapConfig.Folder, imapConfig.Addr, imapConfig.Interval)
+		if err := watcher.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatalf("Failed to watch IMAP folder: %v", err)
+		}
+		fmt.Println("Stopped watching.")
+		return
+	} else if *serveSMTPFlag {
+		// Process newsletters as they are forwarded to us
+		smtpConfig, err := smtpserver.LoadConfigFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to configure SMTP receiver: %v", err)
+		}
+		if *smtpAddrFlag != "" {
+			smtpConfig.Addr = *smtpAddrFlag
+		}
+		config := sender.LoadEmailConfigFromEnv()
+		server, err := smtpserver.New(smtpConfig, func(ctx context.Context, article *scraper.Article) error {
+			fmt.Printf("Processing: %s by %s\n", article.Title, article.Author)
+			return convertAndSend(ctx, article, *format, cleanOptions, convertOptions, config)
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure SMTP receiver: %v", err)
+		}
+
+		// Stop accepting mail on Ctrl+C; a second Ctrl+C also abandons the queue
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+
+		fmt.Printf("Receiving newsletters on %s...\n", smtpConfig.Addr)
+		if err := server.ListenAndServe(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatalf("SMTP receiver failed: %v", err)
+		}
+		fmt.Println("Stopped receiving.")
+		return
+	} else if *pdfFlag != "" {
 		// Process PDF file
 		fmt.Println("Processing PDF file:", *pdfFlag)
 
@@ -96,47 +445,43 @@ func main() {
 			if len(flag.Args()) > 0 {
 				articleURL = flag.Args()[0]
 			} else {
-				log.Fatal("Please provide either a Substack article URL using the -url flag or a PDF file using the -pdf flag")
+				log.Fatal("Please provide either a Substack article URL using the -url flag, a publication using the -feed or -archive flag, a saved page using the -html flag, newsletter emails using the -email flag, or a PDF file using the -pdf flag")
 			}
 		}
 
-		// Validate URL
-		parsedURL, err := url.Parse(articleURL)
+		// Resolve share links and app links, and drop tracking parameters
+		canonicalURL, err := scraper.CanonicalURL(ctx, articleURL)
 		if err != nil {
-			log.Fatalf("Invalid URL: %v", err)
+			log.Fatalf("Failed to resolve URL: %v", err)
+		}
+		if canonicalURL != articleURL {
+			fmt.Println("Resolved URL to:", canonicalURL)
 		}
+		articleURL = canonicalURL
 
-		// Check if it's a Substack URL
-		host := parsedURL.Host
-		if !strings.HasSuffix(host, "substack.com") && !strings.Contains(host, ".substack.") {
-			log.Fatal("The URL must be from a Substack site")
+		// Find the source for the URL, including Substack on custom domains
+		source, doc, err := scraper.Lookup(ctx, articleURL)
+		if errors.Is(err, scraper.ErrNoSource) {
+			log.Fatalf("Unsupported page: %v (no article content was found)", err)
+		}
+		if err != nil {
+			log.Fatalf("Failed to check URL: %v", err)
 		}
 
 		// Step 1: Scrape the article
-		fmt.Println("Scraping article from:", articleURL)
-		article, err := scraper.ScrapeSubstack(articleURL)
+		fmt.Printf("Scraping %s article from: %s\n", source.Name(), articleURL)
+		article, err := source.Fetch(ctx, articleURL, doc)
 		if err != nil {
 			log.Fatalf("Failed to scrape article: %v", err)
 		}
 		fmt.Printf("Successfully scraped article: %s by %s\n", article.Title, article.Author)
+		addComments(ctx, article, commentOptions)
 
 		// Step 2: Convert to the specified format
-		fmt.Printf("Converting article to %s format...\n", strings.ToUpper(*format))
-
-		switch *format {
-		case "epub":
-			result, err = converter.ConvertToEPUB(article)
-		case "azw3":
-			result, err = converter.ConvertToAZW3(article)
-		case "mobi":
-			result, err = converter.ConvertToMOBI(article)
-		}
-
+		result, err = convertArticle(ctx, article, *format, cleanOptions, convertOptions)
 		if err != nil {
 			log.Fatalf("Failed to convert article: %v", err)
 		}
-
-		fmt.Printf("Conversion successful: %s\n", result.FilePath)
 	}
 
 	// Step 3: Send to Kindle
@@ -152,3 +497,106 @@ func main() {
 	os.Remove(result.FilePath)
 	fmt.Println("Temporary files cleaned up.")
 }
+
+// addComments loads the comment thread of an article if comments were requested.
+// Articles without comments are still converted, so failures are only logged.
+func addComments(ctx context.Context, article *scraper.Article, options *scraper.CommentOptions) {
+	if options == nil {
+		return
+	}
+
+	comments, err := scraper.FetchComments(ctx, article.URL, options)
+	if err != nil {
+		log.Printf("Warning: Failed to load comments: %v", err)
+		return
+	}
+	article.Comments = comments
+	fmt.Printf("Loaded %d top-level comments\n", len(comments))
+}
+
+// convertArticle cleans up a scraped article and converts it to the requested format
+func convertArticle(ctx context.Context, article *scraper.Article, format string, cleanOptions *cleaner.Options, convertOptions *converter.ConversionOptions) (*converter.ConversionResult, error) {
+	if err := cleaner.Clean(article, cleanOptions); err != nil {
+		return nil, fmt.Errorf("failed to clean up article: %w", err)
+	}
+
+	fmt.Printf("Converting article to %s format...\n", strings.ToUpper(format))
+
+	var result *converter.ConversionResult
+	var err error
+	switch format {
+	case "epub", "azw3", "mobi":
+		result, err = converter.ConvertArticleWithOptions(ctx, article, converter.OutputFormat(format), convertOptions)
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+	if errors.Is(err, scraper.ErrPaywalled) {
+		return nil, fmt.Errorf("%w (use -send-previews to send the preview anyway)", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Conversion successful: %s\n", result.FilePath)
+	return result, nil
+}
+
+// convertAndSend converts an article, sends it to Kindle and removes the temporary file
+func convertAndSend(ctx context.Context, article *scraper.Article, format string, cleanOptions *cleaner.Options, convertOptions *converter.ConversionOptions, config sender.EmailConfig) error {
+	result, err := convertArticle(ctx, article, format, cleanOptions, convertOptions)
+	if err != nil {
+		return fmt.Errorf("failed to convert article: %w", err)
+	}
+	defer os.Remove(result.FilePath)
+
+	fmt.Println("Sending to Kindle...")
+	if err := sender.SendToKindle(result, config); err != nil {
+		return fmt.Errorf("failed to send to Kindle: %w", err)
+	}
+	fmt.Println("Successfully sent to Kindle!")
+
+	return nil
+}
+
+// sendBundle converts articles into one book and sends it to Kindle. Previews
+// of paywalled posts are left out unless previews may be sent. Posts the
+// articles link to that are not in the book are listed, so they can be added.
+func sendBundle(ctx context.Context, title string, articles []*scraper.Article, format string, cleanOptions *cleaner.Options, convertOptions *converter.ConversionOptions, config sender.EmailConfig) error {
+	var chapters []*scraper.Article
+	for _, article := range articles {
+		if article.Truncated && !convertOptions.AllowPreview {
+			log.Printf("Warning: Leaving out %q: %v (use -send-previews to include the preview)", article.Title, scraper.ErrPaywalled)
+			continue
+		}
+		if err := cleaner.Clean(article, cleanOptions); err != nil {
+			return fmt.Errorf("failed to clean up %q: %w", article.Title, err)
+		}
+		chapters = append(chapters, article)
+	}
+	if len(chapters) == 0 {
+		return fmt.Errorf("no posts left to bundle")
+	}
+
+	if linked := converter.LinkedPosts(chapters); len(linked) > 0 {
+		fmt.Printf("The posts link to %d other posts of the publication that are not in the book:\n", len(linked))
+		for _, postURL := range linked {
+			fmt.Println("  " + postURL)
+		}
+	}
+
+	fmt.Printf("Converting %d posts to one %s book...\n", len(chapters), strings.ToUpper(format))
+	result, err := converter.ConvertBundle(ctx, title, chapters, converter.OutputFormat(format), convertOptions)
+	if err != nil {
+		return fmt.Errorf("failed to convert posts: %w", err)
+	}
+	defer os.Remove(result.FilePath)
+	fmt.Printf("Conversion successful: %s\n", result.FilePath)
+
+	fmt.Println("Sending to Kindle...")
+	if err := sender.SendToKindle(result, config); err != nil {
+		return fmt.Errorf("failed to send to Kindle: %w", err)
+	}
+	fmt.Printf("Successfully sent %d posts to Kindle as %q!\n", len(chapters), result.Title)
+
+	return nil
+}
@@ -0,0 +1,39 @@
+// Package allowlist decides which email senders newsletters are accepted from
+package allowlist
+
+import "strings"
+
+// List holds full addresses and domains, with or without "@". A domain also
+// covers its subdomains, and "*" allows every sender.
+type List []string
+
+// Parse reads a comma-separated list, as found in environment variables
+func Parse(value string) List {
+	var list List
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Allows reports whether a sender address matches an entry of the list
+func (l List) Allows(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	_, domain, _ := strings.Cut(address, "@")
+	for _, entry := range l {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "*", entry == address:
+			return true
+		case strings.Contains(entry, "@") && !strings.HasPrefix(entry, "@"):
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "@")
+		if domain != "" && (domain == entry || strings.HasSuffix(domain, "."+entry)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package cleaner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"substack-to-kindle/pkg/scraper"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// substackRules removes Substack's interactive components, which only make
+// sense on the web: subscribe and share widgets, call-to-action buttons,
+// polls and the controls drawn over images. Buttons are only removed when
+// they subscribe, share or open the comments; authors also use them for
+// links that belong to the post, such as "Read the paper".
+var substackRules = []string{
+	".subscription-widget-wrap",
+	".subscription-widget-wrap-editor",
+	".subscribe-widget",
+	"[data-component-name='SubscribeWidgetToDOM']",
+	".button-wrapper:has(" + webOnlyButtons + ")",
+	"[data-component-name='ButtonCreateButton']:has(" + webOnlyButtons + ")",
+	".captioned-button-wrap",
+	"[data-component-name='CaptionedButtonToDOM']",
+	webOnlyButtons,
+	".share-dialog",
+	".post-ufi",
+	".poll-embed",
+	"[data-component-name='PollToDOM']",
+	".image-link-expand",
+	".restack-image",
+	".view-image",
+	"button",
+	"form",
+	"script",
+	"style",
+}
+
+// webOnlyButtons matches Substack's buttons that subscribe, share or open
+// the comments
+const webOnlyButtons = "a.button[href*='/subscribe'], a.button[href*='action=share'], a.button[href*='utm_content=share'], a.button[href*='/comments']"
+
+// Options contains options for cleaning an article
+type Options struct {
+	// ReplaceEmbeds replaces tweets, videos and other embeds with static blocks
+	ReplaceEmbeds bool
+	// Remove lists CSS selectors whose elements are removed from the content
+	Remove []string
+}
+
+// DefaultOptions returns the default cleaning options with the rules for
+// Substack's own components
+func DefaultOptions() *Options {
+	return &Options{
+		ReplaceEmbeds: true,
+		Remove:        append([]string(nil), substackRules...),
+	}
+}
+
+// LoadRules reads removal rules from a file with one CSS selector per line.
+// Blank lines and lines starting with "# " are ignored; a "#" directly
+// followed by a name is an id selector.
+func LoadRules(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer file.Close()
+
+	var rules []string
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "#" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if _, err := cascadia.Compile(line); err != nil {
+			return nil, fmt.Errorf("invalid selector on line %d of %s: %w", lineNumber, path, err)
+		}
+		rules = append(rules, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	return rules, nil
+}
+
+// Clean replaces embeds with static blocks and removes the elements matched
+// by the removal rules from the article content. The image list is updated to
+// the images left in the content, including embed thumbnails.
+func Clean(article *scraper.Article, options *Options) error {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultOptions()
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(article.Content))
+	if err != nil {
+		return fmt.Errorf("failed to parse content: %w", err)
+	}
+	body := doc.Find("body")
+
+	// Embeds are replaced while the markup they are read from is complete.
+	// The removal rules skip the placeholders and everything in them, so
+	// rules such as "img" or "a" cannot empty them; a rule matching an
+	// element around a placeholder still removes both.
+	if options.ReplaceEmbeds {
+		replaceEmbeds(body)
+	}
+
+	for _, rule := range options.Remove {
+		selector, err := cascadia.Compile(rule)
+		if err != nil {
+			return fmt.Errorf("invalid selector %q: %w", rule, err)
+		}
+		body.FindMatcher(selector).Not(embedSelector).Remove()
+	}
+
+	content, err := body.Html()
+	if err != nil {
+		return fmt.Errorf("failed to render content: %w", err)
+	}
+	article.Content = content
+
+	// Only download the images that are still in the content
+	seen := make(map[string]bool)
+	var imageURLs []string
+	body.Find("img[src]").Each(func(i int, img *goquery.Selection) {
+		if src := img.AttrOr("src", ""); src != "" && !seen[src] {
+			seen[src] = true
+			imageURLs = append(imageURLs, src)
+		}
+	})
+	article.ImageURLs = imageURLs
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package cleaner
+
+import (
+	"strings"
+	"testing"
+
+	"substack-to-kindle/pkg/scraper"
+)
+
+func clean(t *testing.T, content string, options *Options) string {
+	t.Helper()
+	article := &scraper.Article{Content: content}
+	if err := Clean(article, options); err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	return article.Content
+}
+
+func TestCleanButtons(t *testing.T) {
+	content := `<p>Intro</p>
+<p class="button-wrapper"><a class="button primary" href="https://example.substack.com/subscribe?utm_source=post"><span>Subscribe now</span></a></p>
+<p class="button-wrapper"><a class="button primary" href="https://example.substack.com/p/post?utm_source=substack&amp;utm_medium=email&amp;utm_content=share&amp;action=share"><span>Share</span></a></p>
+<p class="button-wrapper"><a class="button primary" href="https://example.substack.com/p/post/comments"><span>Leave a comment</span></a></p>
+<p class="button-wrapper"><a class="button primary" href="https://arxiv.org/abs/2401.00001"><span>Read the paper</span></a></p>
+<a class="button" href="https://example.org/data.csv">Download the data</a>
+<a class="button" href="https://example.substack.com/subscribe">Subscribe</a>`
+
+	got := clean(t, content, nil)
+	for _, removed := range []string{"Subscribe", "Share", "Leave a comment"} {
+		if strings.Contains(got, removed) {
+			t.Errorf("%q button was kept:\n%s", removed, got)
+		}
+	}
+	for _, kept := range []string{"Intro", `href="https://arxiv.org/abs/2401.00001"`, "Read the paper", "Download the data"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("%q was removed:\n%s", kept, got)
+		}
+	}
+}
+
+func TestCleanKeepsEmbedPlaceholders(t *testing.T) {
+	content := `<p>Watch <a href="https://example.org">this</a>:</p>
+<div class="youtube-wrap" data-attrs="{&quot;videoId&quot;:&quot;abc123&quot;}"><iframe src="https://www.youtube.com/embed/abc123"></iframe></div>
+<div class="footer"><iframe src="https://example.org/widget"></iframe></div>`
+
+	options := DefaultOptions()
+	options.Remove = append(options.Remove, "a", "img", "p", ".footer")
+	got := clean(t, content, options)
+
+	if strings.Contains(got, "Watch") {
+		t.Errorf("user rule did not remove the paragraph:\n%s", got)
+	}
+	for _, kept := range []string{`class="embed"`, "youtube.com/watch?v=abc123", "<img", "embed-title"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("placeholder lost %q:\n%s", kept, got)
+		}
+	}
+	// A rule matching an element around a placeholder removes both
+	if strings.Contains(got, "example.org/widget") {
+		t.Errorf("placeholder inside a removed element was kept:\n%s", got)
+	}
+}
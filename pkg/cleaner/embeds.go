@@ -0,0 +1,213 @@
+package cleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// embedSelector matches the placeholders of embeds and their contents
+const embedSelector = "div.embed, div.embed *"
+
+// embed is the static form of an embedded tweet, video, player or page
+type embed struct {
+	kind      string
+	title     string
+	text      string
+	url       string
+	thumbnail string
+}
+
+// render returns the HTML block that replaces the embed
+func (e embed) render() string {
+	var b strings.Builder
+	b.WriteString("<div class=\"embed\">\n")
+	if e.thumbnail != "" {
+		fmt.Fprintf(&b, "<p><img src=\"%s\" alt=\"%s\"/></p>\n", html.EscapeString(e.thumbnail), html.EscapeString(e.kind))
+	}
+
+	heading := e.kind
+	if e.title != "" {
+		heading += ": " + e.title
+	}
+	fmt.Fprintf(&b, "<p class=\"embed-title\"><strong>%s</strong></p>\n", html.EscapeString(heading))
+
+	if e.text != "" {
+		for _, paragraph := range strings.Split(e.text, "\n\n") {
+			if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+				fmt.Fprintf(&b, "<p>%s</p>\n", strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br/>"))
+			}
+		}
+	}
+	if e.url != "" {
+		fmt.Fprintf(&b, "<p class=\"embed-source\"><a href=\"%s\">%s</a></p>\n", html.EscapeString(e.url), html.EscapeString(e.url))
+	}
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// replaceEmbeds swaps embedded tweets, YouTube videos, Spotify players and
+// any other iframe or media element for a static block, since none of them
+// work on an e-reader
+func replaceEmbeds(body *goquery.Selection) {
+	body.Find("div.tweet, [data-component-name='Twitter2ToDOM']").Each(func(i int, s *goquery.Selection) {
+		s.ReplaceWithHtml(tweetEmbed(s).render())
+	})
+	body.Find(".youtube-wrap, [data-component-name='Youtube2ToDOM']").Each(func(i int, s *goquery.Selection) {
+		s.ReplaceWithHtml(youtubeEmbed(s).render())
+	})
+	body.Find(".spotify-wrap, [data-component-name='Spotify2ToDOM']").Each(func(i int, s *goquery.Selection) {
+		s.ReplaceWithHtml(spotifyEmbed(s).render())
+	})
+	body.Find("iframe, video, audio, embed, object").Each(func(i int, s *goquery.Selection) {
+		s.ReplaceWithHtml(mediaEmbed(s).render())
+	})
+}
+
+// tweetEmbed reads a tweet from the data Substack stores with the embed,
+// falling back to the rendered tweet
+func tweetEmbed(s *goquery.Selection) embed {
+	var data struct {
+		URL      string `json:"url"`
+		FullText string `json:"full_text"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+		Photos   []struct {
+			ImgURL string `json:"img_url"`
+		} `json:"photos"`
+	}
+	dataAttrs(s, &data)
+
+	e := embed{
+		kind: "Tweet",
+		text: strings.TrimSpace(data.FullText),
+		url:  data.URL,
+	}
+	if data.Name != "" && data.Username != "" {
+		e.title = fmt.Sprintf("%s (@%s)", data.Name, data.Username)
+	} else if data.Username != "" {
+		e.title = "@" + data.Username
+	}
+	if len(data.Photos) > 0 {
+		e.thumbnail = data.Photos[0].ImgURL
+	}
+
+	if e.text == "" {
+		e.text = strings.TrimSpace(s.Find(".tweet-text").First().Text())
+	}
+	if e.url == "" {
+		e.url = s.Find("a[href*='/status/']").First().AttrOr("href", "")
+	}
+	return e
+}
+
+// youtubeEmbed links a YouTube video and shows its thumbnail
+func youtubeEmbed(s *goquery.Selection) embed {
+	var data struct {
+		VideoID string `json:"videoId"`
+	}
+	dataAttrs(s, &data)
+
+	videoID := data.VideoID
+	if videoID == "" {
+		videoID = youtubeVideoID(s.Find("iframe").AttrOr("src", ""))
+	}
+
+	e := embed{kind: "YouTube video", title: strings.TrimSpace(s.Find("iframe").AttrOr("title", ""))}
+	if videoID != "" {
+		e.url = "https://www.youtube.com/watch?v=" + videoID
+		e.thumbnail = "https://img.youtube.com/vi/" + videoID + "/hqdefault.jpg"
+	}
+	return e
+}
+
+// spotifyEmbed shows the title and artwork of a Spotify player
+func spotifyEmbed(s *goquery.Selection) embed {
+	var data struct {
+		Image    string `json:"image"`
+		Title    string `json:"title"`
+		Subtitle string `json:"subtitle"`
+		URL      string `json:"url"`
+	}
+	dataAttrs(s, &data)
+
+	e := embed{
+		kind:      "Spotify",
+		title:     strings.TrimSpace(data.Title),
+		text:      strings.TrimSpace(data.Subtitle),
+		url:       data.URL,
+		thumbnail: data.Image,
+	}
+	if e.url == "" {
+		src := s.AttrOr("src", s.Find("iframe").AttrOr("src", ""))
+		e.url = strings.Replace(src, "open.spotify.com/embed/", "open.spotify.com/", 1)
+	}
+	return e
+}
+
+// mediaEmbed describes any other iframe, video or audio element by its source
+func mediaEmbed(s *goquery.Selection) embed {
+	src := s.AttrOr("src", s.AttrOr("data", ""))
+	if src == "" {
+		src = s.Find("source[src]").First().AttrOr("src", "")
+	}
+
+	e := embed{
+		kind:      "Embedded content",
+		title:     strings.TrimSpace(s.AttrOr("title", "")),
+		url:       src,
+		thumbnail: s.AttrOr("poster", ""),
+	}
+	switch goquery.NodeName(s) {
+	case "video":
+		e.kind = "Video"
+	case "audio":
+		e.kind = "Audio"
+	}
+
+	if videoID := youtubeVideoID(src); videoID != "" {
+		e.kind = "YouTube video"
+		e.url = "https://www.youtube.com/watch?v=" + videoID
+		e.thumbnail = "https://img.youtube.com/vi/" + videoID + "/hqdefault.jpg"
+	} else if parsed, err := url.Parse(src); err == nil && strings.HasSuffix(parsed.Hostname(), "vimeo.com") {
+		e.kind = "Vimeo video"
+		e.url = "https://vimeo.com/" + strings.TrimPrefix(parsed.Path, "/video/")
+	}
+	return e
+}
+
+// youtubeVideoID returns the video ID of a YouTube embed or watch URL
+func youtubeVideoID(src string) string {
+	parsed, err := url.Parse(src)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.TrimPrefix(parsed.Hostname(), "www.")
+	switch host {
+	case "youtube.com", "youtube-nocookie.com", "m.youtube.com":
+		if strings.HasPrefix(parsed.Path, "/embed/") {
+			return strings.Trim(strings.TrimPrefix(parsed.Path, "/embed/"), "/")
+		}
+		return parsed.Query().Get("v")
+	case "youtu.be":
+		return strings.Trim(parsed.Path, "/")
+	}
+	return ""
+}
+
+// dataAttrs decodes the JSON Substack stores in the data-attrs attribute of
+// its components
+func dataAttrs(s *goquery.Selection, v interface{}) {
+	raw := s.AttrOr("data-attrs", "")
+	if raw == "" {
+		raw = s.Find("[data-attrs]").First().AttrOr("data-attrs", "")
+	}
+	if raw != "" {
+		json.Unmarshal([]byte(raw), v)
+	}
+}
@@ -0,0 +1,197 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"substack-to-kindle/pkg/scraper"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ConvertBundle converts several articles into one book with a chapter for
+// each. Links from one article to another in the book are turned into links
+// to its chapter. An empty title is replaced by the publication and the
+// number of posts.
+func ConvertBundle(ctx context.Context, title string, articles []*scraper.Article, format OutputFormat, options *ConversionOptions) (*ConversionResult, error) {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultOptions()
+	}
+
+	if len(articles) == 0 {
+		return nil, fmt.Errorf("no articles to bundle")
+	}
+
+	// Don't let a teaser pass for the whole post
+	for _, article := range articles {
+		if article.Truncated && !options.AllowPreview {
+			return nil, fmt.Errorf("%s: %w", article.URL, scraper.ErrPaywalled)
+		}
+	}
+
+	return convertBook(ctx, bundleBook(title, articles), articles, format, options)
+}
+
+// bundleBook returns the metadata of a book made of several articles: the
+// authors of all of them, and the publication, language and cover of the first
+func bundleBook(title string, articles []*scraper.Article) *scraper.Article {
+	first := articles[0]
+	book := &scraper.Article{
+		Title:         title,
+		Publication:   first.Publication,
+		Language:      first.Language,
+		CoverImageURL: first.CoverImageURL,
+	}
+
+	seen := make(map[string]bool)
+	for _, article := range articles {
+		for _, author := range bookAuthors(article) {
+			if author != "" && !seen[author] {
+				seen[author] = true
+				book.Authors = append(book.Authors, author)
+			}
+		}
+		if book.CoverImageURL == "" {
+			book.CoverImageURL = article.CoverImageURL
+		}
+		if article.PublishedAt.After(book.PublishedAt) {
+			book.PublishedAt = article.PublishedAt
+		}
+	}
+	book.Author = strings.Join(book.Authors, ", ")
+
+	name := book.Publication
+	if name == "" {
+		name = book.Author
+	}
+	if book.Title == "" {
+		book.Title = fmt.Sprintf("%s: %d posts", name, len(articles))
+	}
+	book.Description = fmt.Sprintf("%d posts from %s", len(articles), name)
+
+	return book
+}
+
+// chapterFilename returns the EPUB section file of the chapter of an article
+func chapterFilename(index int) string {
+	return fmt.Sprintf("article-%d.xhtml", index+1)
+}
+
+// chapterID returns the id of the element wrapping the chapter of an article
+func chapterID(index int) string {
+	return fmt.Sprintf("article-%d", index+1)
+}
+
+// commentsChapterTitle returns the title of the comments chapter of an
+// article, naming the article when the book holds several
+func commentsChapterTitle(article *scraper.Article, articleCount int, options *ConversionOptions) string {
+	title := localeOf(options).comments
+	if articleCount > 1 {
+		return title + ": " + article.Title
+	}
+	return title
+}
+
+// postKey returns the host and path of a post URL, which identify a post
+// regardless of scheme, tracking parameters and fragment. App links name the
+// post in their query, so it is part of their key.
+func postKey(rawURL string) string {
+	normalized, err := scraper.NormalizeURL(rawURL)
+	if err != nil {
+		return ""
+	}
+	parsedURL, err := url.Parse(normalized)
+	if err != nil {
+		return ""
+	}
+	key := parsedURL.Host + strings.TrimSuffix(parsedURL.Path, "/")
+	if scraper.IsAppLink(parsedURL) {
+		key += "?" + parsedURL.RawQuery
+	}
+	return key
+}
+
+// chapterIndex maps the post key of every article to its chapter
+func chapterIndex(articles []*scraper.Article) map[string]int {
+	index := make(map[string]int)
+	for i, article := range articles {
+		if key := postKey(article.URL); key != "" {
+			if _, exists := index[key]; !exists {
+				index[key] = i
+			}
+		}
+	}
+	return index
+}
+
+// rewriteChapterLinks points links to articles in the book at their chapter,
+// using the href returned by target
+func rewriteChapterLinks(content string, chapters map[string]int, target func(chapter int) string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	changed := false
+	doc.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+		if chapter, ok := chapters[postKey(a.AttrOr("href", ""))]; ok {
+			a.SetAttr("href", target(chapter))
+			changed = true
+		}
+	})
+
+	if !changed {
+		return content
+	}
+	result, err := doc.Find("body").Html()
+	if err != nil {
+		return content
+	}
+	return result
+}
+
+// LinkedPosts returns the posts the articles link to that belong to the
+// same publications but are not among the articles, so they can be added
+// to the book. Only Substack-style /p/{slug} links count as posts.
+func LinkedPosts(articles []*scraper.Article) []string {
+	chapters := chapterIndex(articles)
+	hosts := make(map[string]bool)
+	for _, article := range articles {
+		if parsedURL, err := url.Parse(article.URL); err == nil {
+			hosts[strings.ToLower(parsedURL.Host)] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	var posts []string
+	for _, article := range articles {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(article.Content))
+		if err != nil {
+			continue
+		}
+		doc.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+			normalized, err := scraper.NormalizeURL(a.AttrOr("href", ""))
+			if err != nil {
+				return
+			}
+			parsedURL, err := url.Parse(normalized)
+			if err != nil || !hosts[parsedURL.Host] || !strings.HasPrefix(parsedURL.Path, "/p/") {
+				return
+			}
+			key := postKey(normalized)
+			if _, inBook := chapters[key]; inBook || seen[key] {
+				return
+			}
+			seen[key] = true
+			parsedURL.RawQuery = ""
+			posts = append(posts, parsedURL.String())
+		})
+	}
+
+	sort.Strings(posts)
+	return posts
+}
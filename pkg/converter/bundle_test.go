@@ -0,0 +1,26 @@
+package converter
+
+import "testing"
+
+func TestPostKey(t *testing.T) {
+	same := [][2]string{
+		{"https://example.substack.com/p/post", "http://Example.substack.com/p/post/?r=abc#comments"},
+		{"https://example.substack.com/p/post", "https://example.substack.com/p/post/comments"},
+		{"https://substack.com/app-link/post?publication_id=1&post_id=2", "https://substack.com/app-link/post?post_id=2&publication_id=1&r=abc"},
+	}
+	for _, pair := range same {
+		if postKey(pair[0]) != postKey(pair[1]) {
+			t.Errorf("%s and %s have different keys %q and %q", pair[0], pair[1], postKey(pair[0]), postKey(pair[1]))
+		}
+	}
+
+	different := [][2]string{
+		{"https://example.substack.com/p/post", "https://example.substack.com/p/other"},
+		{"https://substack.com/app-link/post?publication_id=1&post_id=2", "https://substack.com/app-link/post?publication_id=1&post_id=3"},
+	}
+	for _, pair := range different {
+		if postKey(pair[0]) == postKey(pair[1]) {
+			t.Errorf("%s and %s share the key %q", pair[0], pair[1], postKey(pair[0]))
+		}
+	}
+}
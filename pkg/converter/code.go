@@ -0,0 +1,351 @@
+package converter
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Inline styles for highlighted code. Weight and slant keep the token kinds
+// apart on grayscale screens, colors help on color screens and apps.
+const (
+	keywordStyle = "font-weight: bold; color: #00307a;"
+	stringStyle  = "color: #8a1f11;"
+	commentStyle = "font-style: italic; color: #4a6b2f;"
+	numberStyle  = "color: #6b3fa0;"
+)
+
+// codeLanguage describes the lexical rules a language needs for highlighting
+type codeLanguage struct {
+	keywords      map[string]bool
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	ignoreCase    bool
+}
+
+// keywords builds a keyword set from a space-separated list
+func keywords(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, keyword := range strings.Fields(list) {
+		set[keyword] = true
+	}
+	return set
+}
+
+var (
+	cLike = [][2]string{{"/*", "*/"}}
+
+	goLanguage = &codeLanguage{
+		keywords:      keywords("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		lineComments:  []string{"//"},
+		blockComments: cLike,
+		quotes:        "\"'`",
+	}
+	pythonLanguage = &codeLanguage{
+		keywords:     keywords("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	javascriptLanguage = &codeLanguage{
+		keywords:      keywords("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while with yield null undefined true false interface type enum implements public private protected readonly"),
+		lineComments:  []string{"//"},
+		blockComments: cLike,
+		quotes:        "\"'`",
+	}
+	javaLanguage = &codeLanguage{
+		keywords:      keywords("abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new package private protected public return short static super switch synchronized this throw throws try void volatile while null true false var val fun when object override"),
+		lineComments:  []string{"//"},
+		blockComments: cLike,
+		quotes:        "\"'",
+	}
+	cLanguage = &codeLanguage{
+		keywords:      keywords("auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while bool class namespace template typename public private protected virtual new delete this nullptr true false using include define"),
+		lineComments:  []string{"//"},
+		blockComments: cLike,
+		quotes:        "\"'",
+	}
+	rustLanguage = &codeLanguage{
+		keywords:      keywords("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		lineComments:  []string{"//"},
+		blockComments: cLike,
+		quotes:        "\"",
+	}
+	rubyLanguage = &codeLanguage{
+		keywords:     keywords("alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	shellLanguage = &codeLanguage{
+		keywords:     keywords("if then else elif fi case esac for while until do done in function return export local echo exit set unset source"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	}
+	sqlLanguage = &codeLanguage{
+		keywords:      keywords("select from where and or not insert into values update set delete create table drop alter index join left right inner outer on group by order having limit offset as distinct union all null is in like between case when then else end primary key foreign references default"),
+		lineComments:  []string{"--"},
+		blockComments: cLike,
+		quotes:        "'\"",
+		ignoreCase:    true,
+	}
+)
+
+// codeLanguages maps language names, as used in language-* classes, to their rules
+var codeLanguages = map[string]*codeLanguage{
+	"go": goLanguage, "golang": goLanguage,
+	"python": pythonLanguage, "py": pythonLanguage,
+	"javascript": javascriptLanguage, "js": javascriptLanguage, "jsx": javascriptLanguage,
+	"typescript": javascriptLanguage, "ts": javascriptLanguage, "tsx": javascriptLanguage,
+	"java": javaLanguage, "kotlin": javaLanguage, "scala": javaLanguage, "csharp": javaLanguage, "cs": javaLanguage,
+	"c": cLanguage, "cpp": cLanguage, "c++": cLanguage, "h": cLanguage, "objc": cLanguage,
+	"rust": rustLanguage, "rs": rustLanguage,
+	"ruby": rubyLanguage, "rb": rubyLanguage,
+	"bash": shellLanguage, "sh": shellLanguage, "shell": shellLanguage, "zsh": shellLanguage,
+	"sql": sqlLanguage,
+}
+
+// highlightCode adds inline-styled syntax highlighting to code blocks whose
+// language is known from a language-* or lang-* class. Blocks that already
+// carry markup, such as those highlighted by the publisher, are left alone.
+func highlightCode(content string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	changed := false
+	doc.Find("pre").Each(func(i int, pre *goquery.Selection) {
+		code := pre.Find("code").First()
+		if code.Length() == 0 {
+			code = pre
+		}
+		if code.Children().Length() > 0 {
+			return
+		}
+
+		language := codeLanguages[codeLanguageName(code)]
+		if language == nil {
+			language = codeLanguages[codeLanguageName(pre)]
+		}
+		if language == nil {
+			language = codeLanguages[codeLanguageName(pre.ParentsFiltered("[data-attrs]").First())]
+		}
+		if language == nil {
+			return
+		}
+
+		code.SetHtml(highlightSource(code.Text(), language))
+		changed = true
+	})
+
+	if !changed {
+		return content
+	}
+	result, err := doc.Find("body").Html()
+	if err != nil {
+		return content
+	}
+	return result
+}
+
+// codeLanguageName returns the language named by a language-*, lang-* or
+// Substack data-attrs language, in lower case
+func codeLanguageName(s *goquery.Selection) string {
+	for _, class := range strings.Fields(s.AttrOr("class", "")) {
+		for _, prefix := range []string{"language-", "lang-"} {
+			if strings.HasPrefix(class, prefix) {
+				return strings.ToLower(strings.TrimPrefix(class, prefix))
+			}
+		}
+	}
+
+	attrs := s.AttrOr("data-attrs", "")
+	if i := strings.Index(attrs, `"language":"`); i >= 0 {
+		name := attrs[i+len(`"language":"`):]
+		if end := strings.Index(name, `"`); end >= 0 {
+			return strings.ToLower(name[:end])
+		}
+	}
+	return ""
+}
+
+// highlightSource renders source code as escaped HTML with styled spans for
+// keywords, strings, comments and numbers
+func highlightSource(source string, language *codeLanguage) string {
+	var b strings.Builder
+	span := func(style, text string) {
+		b.WriteString(`<span style="` + style + `">` + html.EscapeString(text) + "</span>")
+	}
+
+	// scan returns the offset after the runes from offset j that match
+	scan := func(j int, match func(r rune) bool) int {
+		for j < len(source) {
+			r, size := utf8.DecodeRuneInString(source[j:])
+			if !match(r) {
+				break
+			}
+			j += size
+		}
+		return j
+	}
+
+	// Offsets are in bytes, so no suffix of the source is ever copied
+	for i := 0; i < len(source); {
+		// Comments run to the end of the line or the closing delimiter
+		if end := commentEnd(source[i:], language); end > 0 {
+			span(commentStyle, source[i:i+end])
+			i += end
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(source[i:])
+		switch {
+		case strings.ContainsRune(language.quotes, r):
+			escaped := false
+			j := scan(i+size, func(c rune) bool {
+				if escaped {
+					escaped = false
+					return true
+				}
+				escaped = c == '\\'
+				return c != r && (c != '\n' || r == '`')
+			})
+			if c, n := utf8.DecodeRuneInString(source[j:]); c == r {
+				j += n
+			}
+			span(stringStyle, source[i:j])
+			i = j
+		case unicode.IsDigit(r):
+			j := scan(i, func(c rune) bool {
+				return unicode.IsDigit(c) || unicode.IsLetter(c) || c == '.' || c == '_'
+			})
+			span(numberStyle, source[i:j])
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := scan(i, func(c rune) bool {
+				return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+			})
+			word := source[i:j]
+			lookup := word
+			if language.ignoreCase {
+				lookup = strings.ToLower(word)
+			}
+			if language.keywords[lookup] {
+				span(keywordStyle, word)
+			} else {
+				b.WriteString(html.EscapeString(word))
+			}
+			i = j
+		default:
+			b.WriteString(html.EscapeString(source[i : i+size]))
+			i += size
+		}
+	}
+
+	return b.String()
+}
+
+// commentEnd returns the length in bytes of the comment at the start of
+// source, or 0 if source does not start with a comment
+func commentEnd(source string, language *codeLanguage) int {
+	for _, marker := range language.lineComments {
+		if strings.HasPrefix(source, marker) {
+			if end := strings.Index(source, "\n"); end >= 0 {
+				return end
+			}
+			return len(source)
+		}
+	}
+	for _, delimiters := range language.blockComments {
+		if strings.HasPrefix(source, delimiters[0]) {
+			if end := strings.Index(source[len(delimiters[0]):], delimiters[1]); end >= 0 {
+				return len(delimiters[0]) + end + len(delimiters[1])
+			}
+			return len(source)
+		}
+	}
+	return 0
+}
+
+// preserveCodeWhitespace makes the whitespace in code blocks explicit with
+// line breaks and non-breaking spaces, since Kindle formats do not reliably
+// keep it. Single spaces stay breakable so long lines can still wrap.
+func preserveCodeWhitespace(content string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	pres := doc.Find("pre")
+	if pres.Length() == 0 {
+		return content
+	}
+
+	pres.Each(func(i int, pre *goquery.Selection) {
+		var textNodes []*xhtml.Node
+		var collect func(n *xhtml.Node)
+		collect = func(n *xhtml.Node) {
+			for child := n.FirstChild; child != nil; child = child.NextSibling {
+				if child.Type == xhtml.TextNode {
+					textNodes = append(textNodes, child)
+				} else {
+					collect(child)
+				}
+			}
+		}
+		collect(pre.Get(0))
+
+		for _, node := range textNodes {
+			// A leading newline right after <pre> is not part of the code
+			text := node.Data
+			if node == pre.Get(0).FirstChild {
+				text = strings.TrimPrefix(text, "\n")
+			}
+
+			for j, line := range strings.Split(text, "\n") {
+				if j > 0 {
+					node.Parent.InsertBefore(&xhtml.Node{Type: xhtml.ElementNode, Data: "br", DataAtom: atom.Br}, node)
+				}
+				if line != "" {
+					node.Parent.InsertBefore(&xhtml.Node{Type: xhtml.TextNode, Data: explicitSpaces(line)}, node)
+				}
+			}
+			node.Parent.RemoveChild(node)
+		}
+	})
+
+	result, err := doc.Find("body").Html()
+	if err != nil {
+		return content
+	}
+	return result
+}
+
+// explicitSpaces turns tabs, leading spaces and runs of spaces into
+// non-breaking spaces, keeping the last space of a run breakable
+func explicitSpaces(line string) string {
+	const nbsp = "\u00a0"
+	line = strings.ReplaceAll(line, "\t", "    ")
+
+	var b strings.Builder
+	runes := []rune(line)
+	for i, r := range runes {
+		if r != ' ' {
+			b.WriteRune(r)
+			continue
+		}
+		leading := strings.TrimLeft(string(runes[:i]), " ") == ""
+		followedBySpace := i+1 < len(runes) && runes[i+1] == ' '
+		if leading || followedBySpace {
+			b.WriteString(nbsp)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
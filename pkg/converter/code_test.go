@@ -0,0 +1,48 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHighlightSource(t *testing.T) {
+	keyword := func(s string) string { return `<span style="` + keywordStyle + `">` + s + "</span>" }
+	str := func(s string) string { return `<span style="` + stringStyle + `">` + s + "</span>" }
+	comment := func(s string) string { return `<span style="` + commentStyle + `">` + s + "</span>" }
+	number := func(s string) string { return `<span style="` + numberStyle + `">` + s + "</span>" }
+
+	tests := []struct {
+		name     string
+		language string
+		source   string
+		want     string
+	}{
+		{"keywords and identifiers", "go", "func main() {}", keyword("func") + " main() {}"},
+		{"numbers", "go", "x := 0x1F + 3.5", "x := " + number("0x1F") + " + " + number("3.5")},
+		{"string with escapes", "go", `s := "a \"b\" c"`, "s := " + str(`&#34;a \&#34;b\&#34; c&#34;`)},
+		{"unterminated string ends at the line", "python", "s = 'abc\nx = 1", "s = " + str("&#39;abc") + "\nx = " + number("1")},
+		{"raw string spans lines", "go", "`a\nb`", str("`a\nb`")},
+		{"line comment", "python", "x = 1  # note\ny", "x = " + number("1") + "  " + comment("# note") + "\ny"},
+		{"block comment", "c", "int /* a\nb */ x;", keyword("int") + " " + comment("/* a\nb */") + " x;"},
+		{"unterminated block comment", "go", "x /* open", "x " + comment("/* open")},
+		{"case-insensitive keywords", "sql", "SELECT x FROM t", keyword("SELECT") + " x " + keyword("FROM") + " t"},
+		{"non-ASCII text", "go", `// héllo ✓` + "\nvar café = \"naïve\" // ünïcode", comment("// héllo ✓") + "\n" + keyword("var") + " café = " + str("&#34;naïve&#34;") + " " + comment("// ünïcode")},
+		{"markup is escaped", "js", "if (a < b && c > d) {}", keyword("if") + " (a &lt; b &amp;&amp; c &gt; d) {}"},
+		{"trailing backslash", "go", `"abc\`, str(`&#34;abc\`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSource(tt.source, codeLanguages[tt.language]); got != tt.want {
+				t.Errorf("highlightSource(%q)\n got: %s\nwant: %s", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkHighlightSource(b *testing.B) {
+	source := strings.Repeat("// Compute the total\nfunc total(xs []int) int {\n\tsum := 0 // naïve\n\tfor _, x := range xs {\n\t\tsum += x * 2\n\t}\n\treturn sum\n}\n", 2000)
+	b.SetBytes(int64(len(source)))
+	for i := 0; i < b.N; i++ {
+		highlightSource(source, goLanguage)
+	}
+}
@@ -0,0 +1,51 @@
+package converter
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"substack-to-kindle/pkg/scraper"
+)
+
+// commentsHTML renders the comment thread of an article as a chapter body
+func commentsHTML(comments []*scraper.Comment, options *ConversionOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", localeOf(options).comments)
+	writeComments(&b, comments, options)
+	return b.String()
+}
+
+// writeComments renders comments with their replies nested inside them
+func writeComments(b *strings.Builder, comments []*scraper.Comment, options *ConversionOptions) {
+	locale := localeOf(options)
+	for _, comment := range comments {
+		b.WriteString("<div class=\"comment\">\n")
+
+		author := comment.Author
+		if author == "" {
+			author = locale.anonymous
+		}
+		meta := []string{"<strong>" + html.EscapeString(author) + "</strong>"}
+		if !comment.Date.IsZero() {
+			meta = append(meta, formatDate(comment.Date, options))
+		}
+		if comment.Likes == 1 {
+			meta = append(meta, locale.oneLike)
+		} else if comment.Likes > 1 {
+			meta = append(meta, fmt.Sprintf(locale.likes, comment.Likes))
+		}
+		fmt.Fprintf(b, "<p class=\"comment-meta\">%s</p>\n", strings.Join(meta, " · "))
+
+		// Comment bodies are plain text, with blank lines between paragraphs
+		for _, paragraph := range strings.Split(comment.Body, "\n\n") {
+			if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+				lines := strings.Split(html.EscapeString(paragraph), "\n")
+				fmt.Fprintf(b, "<p>%s</p>\n", strings.Join(lines, "<br/>"))
+			}
+		}
+
+		writeComments(b, comment.Replies, options)
+		b.WriteString("</div>\n")
+	}
+}
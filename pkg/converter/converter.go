@@ -1,7 +1,10 @@
 package converter
 
 import (
+	"context"
 	"fmt"
+	"html"
+	"image"
 	"io"
 	"log"
 	"math/rand"
@@ -16,9 +19,75 @@ import (
 
 	"github.com/bmaupin/go-epub"
 	"github.com/leotaku/mobi"
-	"golang.org/x/text/language"
+	r "github.com/leotaku/mobi/records"
+	"github.com/vincent-petithory/dataurl"
 )
 
+// stylesheet is the CSS shared by the EPUB and the directly created Kindle formats
+const stylesheet = `
+	body {
+		font-family: serif;
+		margin: 5%;
+		text-align: justify;
+	}
+	h1, h2, h3, h4, h5, h6 {
+		text-align: left;
+		margin-top: 1em;
+	}
+	img {
+		max-width: 100%;
+		height: auto;
+	}
+	blockquote {
+		margin: 1em 2em;
+		font-style: italic;
+	}
+	.footnote {
+		font-size: 0.9em;
+	}
+	pre {
+		margin: 1em 0;
+		padding: 0.5em;
+		border: 1px solid #ccc;
+		font-size: 0.85em;
+		text-align: left;
+		white-space: pre-wrap;
+		word-wrap: break-word;
+	}
+	pre, code, kbd, samp {
+		font-family: monospace;
+		text-align: left;
+		hyphens: none;
+	}
+	.math {
+		margin: 1em 0;
+		text-align: center;
+	}
+	.embed {
+		margin: 1em 0;
+		padding: 0.5em 1em;
+		border: 1px solid #999;
+	}
+	.embed-title, .embed-source {
+		text-align: left;
+	}
+	.comment {
+		margin-top: 1em;
+	}
+	.comment .comment {
+		margin-left: 1.5em;
+	}
+	.comment-meta {
+		margin-bottom: 0.2em;
+		text-align: left;
+	}
+	.preview-notice {
+		padding: 0.5em 1em;
+		border: 2px solid #000;
+		text-align: left;
+	}
+`
+
 // OutputFormat represents the output format for the conversion
 type OutputFormat string
 
@@ -38,8 +107,56 @@ type ConversionResult struct {
 	Author   string
 }
 
+// ConversionOptions contains options for article conversion
+type ConversionOptions struct {
+	// HighlightCode adds syntax highlighting to code blocks of known languages
+	HighlightCode bool
+	// AllowPreview converts the free preview of a paywalled post with a
+	// notice at the top, instead of failing with scraper.ErrPaywalled
+	AllowPreview bool
+	// TimeZone is the zone dates are shown in; nil keeps the zone the
+	// publication gave
+	TimeZone *time.Location
+	// Locale is the language dates are written in, e.g. "en" or "de-DE"
+	Locale string
+	// RenderMathImages sends formulas to MathImageURL to show them as images
+	// in AZW3 and MOBI files; otherwise they are shown as TeX
+	RenderMathImages bool
+}
+
+// DefaultOptions returns the default conversion options
+func DefaultOptions() *ConversionOptions {
+	return &ConversionOptions{
+		HighlightCode: false,
+		AllowPreview:  false,
+		Locale:        "en",
+	}
+}
+
 // ConvertArticle converts a Substack article to the specified format
 func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionResult, error) {
+	return ConvertArticleWithOptions(context.Background(), article, format, nil)
+}
+
+// ConvertArticleWithOptions converts a Substack article to the specified
+// format. The context covers the image downloads.
+func ConvertArticleWithOptions(ctx context.Context, article *scraper.Article, format OutputFormat, options *ConversionOptions) (*ConversionResult, error) {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultOptions()
+	}
+
+	// Don't let a teaser pass for the whole post
+	if article.Truncated && !options.AllowPreview {
+		return nil, fmt.Errorf("%s: %w", article.URL, scraper.ErrPaywalled)
+	}
+
+	return convertBook(ctx, article, []*scraper.Article{article}, format, options)
+}
+
+// convertBook converts articles into a book with a chapter for each. The
+// title, authors, cover and other metadata of the book are taken from book.
+func convertBook(ctx context.Context, book *scraper.Article, articles []*scraper.Article, format OutputFormat, options *ConversionOptions) (*ConversionResult, error) {
 	// Create a temporary directory for our files
 	tempDir, err := os.MkdirTemp("", "substack-kindle-*")
 	if err != nil {
@@ -48,15 +165,15 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 
 	// Generate filename
 	filename := fmt.Sprintf("%s - %s",
-		sanitizeFilename(article.Title),
-		sanitizeFilename(article.Author))
+		sanitizeFilename(book.Title),
+		sanitizeFilename(book.Author))
 
 	var outputPath string
 
 	// For EPUB format
 	if format == FormatEPUB {
 		fmt.Println("Creating EPUB file...")
-		epubPath, err := createEPUB(article, tempDir)
+		epubPath, err := createEPUB(ctx, book, articles, tempDir, options)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create EPUB: %w", err)
 		}
@@ -65,7 +182,7 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 		// Try using Calibre first (better quality conversion)
 		if isEbookConvertAvailable() {
 			fmt.Println("Creating EPUB file...")
-			epubPath, err := createEPUB(article, tempDir)
+			epubPath, err := createEPUB(ctx, book, articles, tempDir, options)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create EPUB: %w", err)
 			}
@@ -86,7 +203,7 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 		if outputPath == "" {
 			fmt.Println("Creating AZW3 file directly...")
 			azw3Path := filepath.Join(tempDir, filename+".azw3")
-			err := createAZW3(article, azw3Path)
+			err := createAZW3(ctx, book, articles, azw3Path, options)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create AZW3: %w", err)
 			}
@@ -96,7 +213,7 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 		// Try using Calibre first (better quality conversion)
 		if isEbookConvertAvailable() {
 			fmt.Println("Creating EPUB file...")
-			epubPath, err := createEPUB(article, tempDir)
+			epubPath, err := createEPUB(ctx, book, articles, tempDir, options)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create EPUB: %w", err)
 			}
@@ -117,7 +234,7 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 		if outputPath == "" {
 			fmt.Println("Creating MOBI file directly...")
 			mobiPath := filepath.Join(tempDir, filename+".mobi")
-			err := createMOBI(article, mobiPath)
+			err := createMOBI(ctx, book, articles, mobiPath, options)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create MOBI: %w", err)
 			}
@@ -129,8 +246,8 @@ func ConvertArticle(article *scraper.Article, format OutputFormat) (*ConversionR
 
 	return &ConversionResult{
 		FilePath: outputPath,
-		Title:    article.Title,
-		Author:   article.Author,
+		Title:    book.Title,
+		Author:   book.Author,
 	}, nil
 }
 
@@ -171,94 +288,131 @@ func convertToFormat(epubPath, format string) (string, error) {
 	return outputPath, nil
 }
 
-// createAZW3 creates an AZW3 file directly from the article using the leotaku/mobi library
-func createAZW3(article *scraper.Article, outputPath string) error {
-	return createMobiFormat(article, outputPath, "azw3")
+// createAZW3 creates an AZW3 file directly from the articles using the leotaku/mobi library
+func createAZW3(ctx context.Context, book *scraper.Article, articles []*scraper.Article, outputPath string, options *ConversionOptions) error {
+	return createMobiFormat(ctx, book, articles, outputPath, "azw3", options)
 }
 
-// createMOBI creates a MOBI file directly from the article using the leotaku/mobi library
-func createMOBI(article *scraper.Article, outputPath string) error {
-	return createMobiFormat(article, outputPath, "mobi")
+// createMOBI creates a MOBI file directly from the articles using the leotaku/mobi library
+func createMOBI(ctx context.Context, book *scraper.Article, articles []*scraper.Article, outputPath string, options *ConversionOptions) error {
+	return createMobiFormat(ctx, book, articles, outputPath, "mobi", options)
 }
 
-// createMobiFormat creates a MOBI or AZW3 file directly from the article
-func createMobiFormat(article *scraper.Article, outputPath, format string) error {
-	// Download images to temporary directory
+// createMobiFormat creates a MOBI or AZW3 file directly from the articles
+func createMobiFormat(ctx context.Context, book *scraper.Article, articles []*scraper.Article, outputPath, format string, options *ConversionOptions) error {
 	tempDir := filepath.Dir(outputPath)
-	imageMap := make(map[string]string)
-
-	for _, imgURL := range article.ImageURLs {
-		imgPath, err := downloadImage(imgURL, tempDir)
-		if err != nil {
-			continue // Skip this image if download fails
+	chapterLinks := chapterIndex(articles)
+
+	var images []image.Image
+	embedded := make(map[string]string)
+	var titles, bodies []string
+	for i, article := range articles {
+		// Links to other articles in the book lead to their chapter
+		content := rewriteChapterLinks(article.Content, chapterLinks, func(chapter int) string {
+			return "#" + chapterID(chapter)
+		})
+		if options.HighlightCode {
+			content = highlightCode(content)
 		}
-		imageMap[imgURL] = imgPath
-	}
 
-	// Replace image URLs in content with local file references
-	content := article.Content
-	for origURL, localPath := range imageMap {
-		content = strings.ReplaceAll(content, origURL, filepath.Base(localPath))
-	}
+		// Kindle formats cannot show MathML, so formulas become images or TeX
+		content, mathImageURLs := mobiMath(mobiFootnotes(preserveCodeWhitespace(content)), options.RenderMathImages)
+
+		// Download images to temporary directory and embed them in the book,
+		// once for all articles that show them
+		for _, imgURL := range append(append([]string(nil), article.ImageURLs...), mathImageURLs...) {
+			embedURL, ok := embedded[imgURL]
+			if !ok {
+				imgPath, err := downloadImage(ctx, imgURL, tempDir)
+				if err != nil {
+					continue // Skip this image if download fails
+				}
+				img, err := loadImage(imgPath)
+				if err != nil {
+					continue
+				}
+				images = append(images, img)
 
-	// Create HTML content
-	htmlContent := fmt.Sprintf(`
+				// Embedded images are numbered from 1 in base 32
+				embedURL = fmt.Sprintf("kindle:embed:%s?mime=image/jpeg", r.To32(len(images)))
+				embedded[imgURL] = embedURL
+			}
+			content = replaceImageURL(content, imgURL, embedURL)
+		}
+
+		// Create HTML content
+		htmlContent := fmt.Sprintf(`
 		<html>
 		<head>
 			<title>%s</title>
-			<style>
-				body {
-					font-family: serif;
-					margin: 5%%;
-					text-align: justify;
-				}
-				h1, h2, h3, h4, h5, h6 {
-					text-align: left;
-					margin-top: 1em;
-				}
-				img {
-					max-width: 100%%;
-					height: auto;
-				}
-				blockquote {
-					margin: 1em 2em;
-					font-style: italic;
-				}
-			</style>
+			<style>%s</style>
 		</head>
 		<body>
-			<h1>%s</h1>
-			<p><strong>By %s</strong></p>
-			<p><em>Published: %s</em></p>
-			<p><em>Source: <a href="%s">%s</a></em></p>
-			<hr/>
+			<div id="%s">
+			%s
 			%s
+			</div>
 		</body>
 		</html>
 	`,
-		article.Title,
-		article.Title,
-		article.Author,
-		article.PublishedAt.Format("January 2, 2006"),
-		article.URL,
-		article.URL,
-		content,
-	)
+			html.EscapeString(article.Title),
+			stylesheet,
+			chapterID(i),
+			articleHeader(article, options),
+			content,
+		)
+
+		// Create a chapter with the article content and one for the comments
+		titles = append(titles, article.Title)
+		bodies = append(bodies, htmlContent)
+		if len(article.Comments) > 0 {
+			title := commentsChapterTitle(article, len(articles), options)
+			titles = append(titles, title)
+			bodies = append(bodies, fmt.Sprintf(`
+		<html>
+		<head>
+			<title>%s</title>
+			<style>%s</style>
+		</head>
+		<body>
+			%s
+		</body>
+		</html>
+	`, html.EscapeString(title), stylesheet, commentsHTML(article.Comments, options)))
+		}
+	}
 
-	// Create a chapter with the article content
-	ch := mobi.Chapter{
-		Title:  article.Title,
-		Chunks: mobi.Chunks(htmlContent),
+	// Point internal links at positions Kindle can follow
+	var chapters []mobi.Chapter
+	for i, body := range resolveMobiLinks(bodies) {
+		chapters = append(chapters, mobi.Chapter{
+			Title:  titles[i],
+			Chunks: mobi.Chunks(body),
+		})
 	}
 
 	// Create the book
 	mb := mobi.Book{
-		Title:       article.Title,
-		Authors:     []string{article.Author},
-		CreatedDate: time.Now(),
-		Language:    language.English,
-		Chapters:    []mobi.Chapter{ch},
-		UniqueID:    rand.Uint32(),
+		Title:         book.Title,
+		Authors:       bookAuthors(book),
+		Publisher:     book.Publication,
+		Subject:       bookSubject(book),
+		CreatedDate:   time.Now(),
+		PublishedDate: book.PublishedAt,
+		Language:      bookLanguage(book),
+		Chapters:      chapters,
+		Images:        images,
+		UniqueID:      rand.Uint32(),
+	}
+
+	// Add the cover image if it can be downloaded and decoded
+	if book.CoverImageURL != "" {
+		coverPath, err := downloadImage(ctx, book.CoverImageURL, tempDir)
+		if err == nil {
+			if cover, err := loadImage(coverPath); err == nil {
+				mb.CoverImage = cover
+			}
+		}
 	}
 
 	// Convert book to PalmDB database
@@ -279,57 +433,26 @@ func createMobiFormat(article *scraper.Article, outputPath, format string) error
 	return nil
 }
 
-// createEPUB creates an EPUB file from the article
-func createEPUB(article *scraper.Article, tempDir string) (string, error) {
+// createEPUB creates an EPUB file from the articles
+func createEPUB(ctx context.Context, book *scraper.Article, articles []*scraper.Article, tempDir string, options *ConversionOptions) (string, error) {
 	// Create a new EPUB
-	e := epub.NewEpub(article.Title)
-	e.SetAuthor(article.Author)
-
-	// Download and add images
-	imageMap := make(map[string]string)
-	for _, imgURL := range article.ImageURLs {
-		imgPath, err := downloadImage(imgURL, tempDir)
-		if err != nil {
-			continue // Skip this image if download fails
-		}
-
-		// Add image to EPUB
-		imgFilename := filepath.Base(imgPath)
-		internalPath, err := e.AddImage(imgPath, imgFilename)
-		if err != nil {
-			continue
-		}
-
-		// Map original URL to internal EPUB path
-		imageMap[imgURL] = internalPath
-	}
-
-	// Replace image URLs in content
-	content := article.Content
-	for origURL, epubPath := range imageMap {
-		content = strings.ReplaceAll(content, origURL, epubPath)
+	e := epub.NewEpub(book.Title)
+	e.SetAuthor(bookAuthors(book)[0])
+	e.SetLang(bookLanguage(book).String())
+	if description := bookDescription(book); description != "" {
+		e.SetDescription(description)
 	}
 
-	// Add CSS
-	cssContent := `
-		body {
-			font-family: serif;
-			margin: 5%;
-			text-align: justify;
-		}
-		h1, h2, h3, h4, h5, h6 {
-			text-align: left;
-			margin-top: 1em;
-		}
-		img {
-			max-width: 100%;
-			height: auto;
-		}
-		blockquote {
-			margin: 1em 2em;
-			font-style: italic;
+	// Add the cover image
+	if book.CoverImageURL != "" {
+		coverPath, err := downloadImage(ctx, book.CoverImageURL, tempDir)
+		if err == nil {
+			internalPath, err := e.AddImage(coverPath, "cover-"+filepath.Base(coverPath))
+			if err == nil {
+				e.SetCover(internalPath, "")
+			}
 		}
-	`
+	}
 
 	// Create a temporary CSS file
 	cssFile, err := os.CreateTemp(tempDir, "style-*.css")
@@ -338,7 +461,7 @@ func createEPUB(article *scraper.Article, tempDir string) (string, error) {
 	}
 	defer cssFile.Close()
 
-	_, err = cssFile.WriteString(cssContent)
+	_, err = cssFile.WriteString(stylesheet)
 	if err != nil {
 		return "", fmt.Errorf("failed to write CSS content: %w", err)
 	}
@@ -349,43 +472,99 @@ func createEPUB(article *scraper.Article, tempDir string) (string, error) {
 		return "", fmt.Errorf("failed to add CSS: %w", err)
 	}
 
-	// Create HTML content with metadata
-	htmlContent := fmt.Sprintf(`
+	chapterLinks := chapterIndex(articles)
+	imageMap := make(map[string]string)
+	var mathSections []string
+	for i, article := range articles {
+		// Download and add images the book doesn't hold yet
+		for _, imgURL := range article.ImageURLs {
+			if _, ok := imageMap[imgURL]; ok {
+				continue
+			}
+			imgPath, err := downloadImage(ctx, imgURL, tempDir)
+			if err != nil {
+				continue // Skip this image if download fails
+			}
+
+			// Add image to EPUB
+			imgFilename := filepath.Base(imgPath)
+			internalPath, err := e.AddImage(imgPath, imgFilename)
+			if err != nil {
+				continue
+			}
+
+			// Map original URL to internal EPUB path
+			imageMap[imgURL] = internalPath
+		}
+
+		// Links to other articles in the book lead to their section
+		content := rewriteChapterLinks(article.Content, chapterLinks, chapterFilename)
+		if options.HighlightCode {
+			content = highlightCode(content)
+		}
+
+		// Replace image URLs in content
+		content, hasMath := epubMath(epubFootnotes(content))
+		for _, imgURL := range article.ImageURLs {
+			if epubPath, ok := imageMap[imgURL]; ok {
+				content = replaceImageURL(content, imgURL, epubPath)
+			}
+		}
+
+		// Create HTML content with metadata
+		htmlContent := fmt.Sprintf(`
 		<html>
 		<head>
 			<title>%s</title>
 			<link rel="stylesheet" type="text/css" href="%s" />
 		</head>
 		<body>
-			<h1>%s</h1>
-			<p><strong>By %s</strong></p>
-			<p><em>Published: %s</em></p>
-			<p><em>Source: <a href="%s">%s</a></em></p>
-			<hr/>
+			%s
 			%s
 		</body>
 		</html>
 	`,
-		article.Title,
-		cssPath,
-		article.Title,
-		article.Author,
-		article.PublishedAt.Format("January 2, 2006"),
-		article.URL,
-		article.URL,
-		content,
-	)
-
-	// Add the section with content
-	_, err = e.AddSection(htmlContent, article.Title, "", "")
-	if err != nil {
-		return "", fmt.Errorf("failed to add content: %w", err)
+			html.EscapeString(article.Title),
+			cssPath,
+			articleHeader(article, options),
+			content,
+		)
+
+		// Add the section with content
+		sectionPath, err := e.AddSection(htmlContent, article.Title, chapterFilename(i), "")
+		if err != nil {
+			return "", fmt.Errorf("failed to add content: %w", err)
+		}
+		if hasMath {
+			mathSections = append(mathSections, sectionPath)
+		}
+
+		// Append the comment thread as its own chapter
+		if len(article.Comments) > 0 {
+			title := commentsChapterTitle(article, len(articles), options)
+			commentsContent := fmt.Sprintf(`
+		<html>
+		<head>
+			<title>%s</title>
+			<link rel="stylesheet" type="text/css" href="%s" />
+		</head>
+		<body>
+			%s
+		</body>
+		</html>
+	`, html.EscapeString(title), cssPath, commentsHTML(article.Comments, options))
+
+			_, err = e.AddSection(commentsContent, title, fmt.Sprintf("comments-%d.xhtml", i+1), "")
+			if err != nil {
+				return "", fmt.Errorf("failed to add comments: %w", err)
+			}
+		}
 	}
 
 	// Generate filename
 	filename := fmt.Sprintf("%s - %s.epub",
-		sanitizeFilename(article.Title),
-		sanitizeFilename(article.Author))
+		sanitizeFilename(book.Title),
+		sanitizeFilename(book.Author))
 	epubPath := filepath.Join(tempDir, filename)
 
 	// Write EPUB to file
@@ -394,12 +573,46 @@ func createEPUB(article *scraper.Article, tempDir string) (string, error) {
 		return "", fmt.Errorf("failed to write EPUB: %w", err)
 	}
 
+	// Add the metadata go-epub has no setters for
+	err = addPackageMetadata(epubPath, book)
+	if err != nil {
+		return "", fmt.Errorf("failed to add EPUB metadata: %w", err)
+	}
+
+	// Reading systems only render MathML in sections declared to contain it
+	for _, sectionPath := range mathSections {
+		err = addManifestProperty(epubPath, sectionPath, "mathml")
+		if err != nil {
+			return "", fmt.Errorf("failed to add EPUB metadata: %w", err)
+		}
+	}
+
 	return epubPath, nil
 }
 
+// replaceImageURL replaces an image URL in HTML content, including where it
+// appears HTML-escaped in an attribute
+func replaceImageURL(content, from, to string) string {
+	content = strings.ReplaceAll(content, from, to)
+	if escaped := html.EscapeString(from); escaped != from {
+		content = strings.ReplaceAll(content, escaped, to)
+	}
+	return content
+}
+
 // downloadImage downloads an image from a URL to the temp directory
-func downloadImage(url string, tempDir string) (string, error) {
-	resp, err := http.Get(url)
+func downloadImage(ctx context.Context, url string, tempDir string) (string, error) {
+	// Images inlined in saved pages need no download
+	if strings.HasPrefix(url, "data:") {
+		return saveDataURL(url, tempDir)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := scraper.HTTPClient().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -411,7 +624,7 @@ func downloadImage(url string, tempDir string) (string, error) {
 
 	// Create a file to save the image
 	filename := filepath.Base(url)
-	if filename == "" || !strings.Contains(filename, ".") {
+	if filename == "" || !strings.Contains(filename, ".") || strings.Contains(filename, "?") || len(filename) > 100 {
 		filename = fmt.Sprintf("image_%d.jpg", time.Now().UnixNano())
 	}
 
@@ -431,6 +644,27 @@ func downloadImage(url string, tempDir string) (string, error) {
 	return imgPath, nil
 }
 
+// saveDataURL writes the image of a data URI to a file in tempDir
+func saveDataURL(url string, tempDir string) (string, error) {
+	data, err := dataurl.DecodeString(url)
+	if err != nil {
+		return "", fmt.Errorf("invalid data URI: %w", err)
+	}
+
+	// Name the file after the image type, e.g. image_1.png or image_2.svg
+	extension := "." + strings.TrimSuffix(data.MediaType.Subtype, "+xml")
+	if data.MediaType.Type != "image" || data.MediaType.Subtype == "jpeg" {
+		extension = ".jpg"
+	}
+
+	imgPath := filepath.Join(tempDir, fmt.Sprintf("image_%d%s", time.Now().UnixNano(), extension))
+	if err := os.WriteFile(imgPath, data.Data, 0644); err != nil {
+		return "", err
+	}
+
+	return imgPath, nil
+}
+
 // sanitizeFilename removes invalid characters from a filename
 func sanitizeFilename(name string) string {
 	// Replace invalid characters with underscores
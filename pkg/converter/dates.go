@@ -0,0 +1,179 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// localeFormat spells out dates and the reader-visible labels of the book in
+// one language
+type localeFormat struct {
+	months [12]string
+	// layout places the day, month and year, e.g. "%[2]s %[1]d, %[3]d"
+	layout string
+	// byline, published, updated and source label the author, the dates and
+	// the link to the post; %s is replaced by each
+	byline, published, updated, source string
+	// preview heads the notice of a paywalled post's free preview, and
+	// previewNotice follows it with %s for the link to the full post
+	preview, previewNotice string
+	// comments titles the comment chapter; oneLike and likes count the
+	// likes of a comment, with %d for the number; anonymous stands in for
+	// comments without an author
+	comments, oneLike, likes, anonymous string
+}
+
+// localeFormats are the languages dates and labels can be written in, by
+// ISO 639-1 code
+var localeFormats = map[string]localeFormat{
+	"en": {
+		months:        [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		layout:        "%[2]s %[1]d, %[3]d",
+		byline:        "By %s",
+		published:     "Published: %s",
+		updated:       "Updated: %s",
+		source:        "Source: %s",
+		preview:       "Preview only:",
+		previewNotice: "this is the free preview of a paywalled post. Read the full post at %s.",
+		comments:      "Comments",
+		oneLike:       "1 like",
+		likes:         "%d likes",
+		anonymous:     "Anonymous",
+	},
+	"de": {
+		months:        [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		layout:        "%[1]d. %[2]s %[3]d",
+		byline:        "Von %s",
+		published:     "Veröffentlicht: %s",
+		updated:       "Aktualisiert: %s",
+		source:        "Quelle: %s",
+		preview:       "Nur Vorschau:",
+		previewNotice: "dies ist die kostenlose Vorschau eines kostenpflichtigen Beitrags. Den vollständigen Beitrag gibt es unter %s.",
+		comments:      "Kommentare",
+		oneLike:       "1 Like",
+		likes:         "%d Likes",
+		anonymous:     "Anonym",
+	},
+	"fr": {
+		months:        [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		layout:        "%[1]d %[2]s %[3]d",
+		byline:        "Par %s",
+		published:     "Publié le %s",
+		updated:       "Mis à jour le %s",
+		source:        "Source\u00a0: %s", // French sets a non-breaking space before colons
+		preview:       "Aperçu seulement\u00a0:",
+		previewNotice: "ceci est l’aperçu gratuit d’un article payant. Lisez l’article complet sur %s.",
+		comments:      "Commentaires",
+		oneLike:       "1 j’aime",
+		likes:         "%d j’aime",
+		anonymous:     "Anonyme",
+	},
+	"es": {
+		months:        [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		layout:        "%[1]d de %[2]s de %[3]d",
+		byline:        "Por %s",
+		published:     "Publicado: %s",
+		updated:       "Actualizado: %s",
+		source:        "Fuente: %s",
+		preview:       "Solo vista previa:",
+		previewNotice: "esta es la vista previa gratuita de una publicación de pago. Lee la publicación completa en %s.",
+		comments:      "Comentarios",
+		oneLike:       "1 me gusta",
+		likes:         "%d me gusta",
+		anonymous:     "Anónimo",
+	},
+	"it": {
+		months:        [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		layout:        "%[1]d %[2]s %[3]d",
+		byline:        "Di %s",
+		published:     "Pubblicato: %s",
+		updated:       "Aggiornato: %s",
+		source:        "Fonte: %s",
+		preview:       "Solo anteprima:",
+		previewNotice: "questa è l’anteprima gratuita di un post a pagamento. Leggi il post completo su %s.",
+		comments:      "Commenti",
+		oneLike:       "1 mi piace",
+		likes:         "%d mi piace",
+		anonymous:     "Anonimo",
+	},
+	"pt": {
+		months:        [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		layout:        "%[1]d de %[2]s de %[3]d",
+		byline:        "Por %s",
+		published:     "Publicado: %s",
+		updated:       "Atualizado: %s",
+		source:        "Fonte: %s",
+		preview:       "Somente prévia:",
+		previewNotice: "esta é a prévia gratuita de uma publicação paga. Leia a publicação completa em %s.",
+		comments:      "Comentários",
+		oneLike:       "1 curtida",
+		likes:         "%d curtidas",
+		anonymous:     "Anônimo",
+	},
+	"nl": {
+		months:        [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		layout:        "%[1]d %[2]s %[3]d",
+		byline:        "Door %s",
+		published:     "Gepubliceerd: %s",
+		updated:       "Bijgewerkt: %s",
+		source:        "Bron: %s",
+		preview:       "Alleen voorbeeld:",
+		previewNotice: "dit is het gratis voorbeeld van een betaald bericht. Lees het volledige bericht op %s.",
+		comments:      "Reacties",
+		oneLike:       "1 like",
+		likes:         "%d likes",
+		anonymous:     "Anoniem",
+	},
+	"sv": {
+		months:        [12]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		layout:        "%[1]d %[2]s %[3]d",
+		byline:        "Av %s",
+		published:     "Publicerad: %s",
+		updated:       "Uppdaterad: %s",
+		source:        "Källa: %s",
+		preview:       "Endast förhandsvisning:",
+		previewNotice: "detta är den kostnadsfria förhandsvisningen av ett betalt inlägg. Läs hela inlägget på %s.",
+		comments:      "Kommentarer",
+		oneLike:       "1 gillning",
+		likes:         "%d gillningar",
+		anonymous:     "Anonym",
+	},
+}
+
+// SupportedLocale reports whether dates and labels can be written in the
+// language of a locale such as "de" or "pt-BR"
+func SupportedLocale(locale string) bool {
+	_, ok := localeFormats[localeLanguage(locale)]
+	return ok
+}
+
+// localeOf returns the language of the options, falling back to English
+func localeOf(options *ConversionOptions) localeFormat {
+	if format, ok := localeFormats[localeLanguage(options.Locale)]; ok {
+		return format
+	}
+	return localeFormats["en"]
+}
+
+// localeLanguage returns the language code of a locale, e.g. "pt" for "pt-BR"
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	return strings.ToLower(language)
+}
+
+// formatDate writes out a date in the time zone and locale of the options,
+// falling back to the date's own zone and English
+func formatDate(t time.Time, options *ConversionOptions) string {
+	format := localeOf(options)
+	t = localTime(t, options)
+	return fmt.Sprintf(format.layout, t.Day(), format.months[t.Month()-1], t.Year())
+}
+
+// localTime returns a date in the time zone of the options
+func localTime(t time.Time, options *ConversionOptions) time.Time {
+	if options.TimeZone != nil {
+		return t.In(options.TimeZone)
+	}
+	return t
+}
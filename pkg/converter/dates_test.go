@@ -0,0 +1,126 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"substack-to-kindle/pkg/scraper"
+)
+
+func TestArticleHeaderLocale(t *testing.T) {
+	article := &scraper.Article{
+		Title:       "Title",
+		Author:      "Jane Doe",
+		URL:         "https://example.substack.com/p/title",
+		PublishedAt: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+		UpdatedAt:   time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC),
+	}
+	link := `<a href="https://example.substack.com/p/title">https://example.substack.com/p/title</a>`
+
+	tests := []struct {
+		locale string
+		want   []string
+	}{
+		{"en", []string{"By Jane Doe", "Published: March 5, 2024", "Updated: March 7, 2024", "Source: " + link}},
+		{"de-DE", []string{"Von Jane Doe", "Veröffentlicht: 5. März 2024", "Aktualisiert: 7. März 2024", "Quelle: " + link}},
+		{"fr", []string{"Par Jane Doe", "Publié le 5 mars 2024", "Mis à jour le 7 mars 2024", "Source\u00a0: " + link}},
+		{"pt_BR", []string{"Por Jane Doe", "Publicado: 5 de março de 2024", "Atualizado: 7 de março de 2024", "Fonte: " + link}},
+		{"sv", []string{"Av Jane Doe", "Publicerad: 5 mars 2024", "Uppdaterad: 7 mars 2024", "Källa: " + link}},
+		// Unknown languages fall back to English
+		{"xx", []string{"By Jane Doe", "Published: March 5, 2024", "Source: " + link}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			options := DefaultOptions()
+			options.Locale = tt.locale
+			header := articleHeader(article, options)
+			for _, want := range tt.want {
+				if !strings.Contains(header, want) {
+					t.Errorf("header lacks %q:\n%s", want, header)
+				}
+			}
+		})
+	}
+}
+
+func TestLocaleFormatsAreComplete(t *testing.T) {
+	for language, format := range localeFormats {
+		for name, label := range map[string]string{
+			"byline": format.byline, "published": format.published, "updated": format.updated, "source": format.source,
+		} {
+			if strings.Count(label, "%s") != 1 {
+				t.Errorf("%s %s label %q needs exactly one %%s", language, name, label)
+			}
+		}
+		if strings.Count(format.previewNotice, "%s") != 1 {
+			t.Errorf("%s preview notice %q needs exactly one %%s", language, format.previewNotice)
+		}
+		if strings.Count(format.likes, "%d") != 1 {
+			t.Errorf("%s likes label %q needs exactly one %%d", language, format.likes)
+		}
+		for name, label := range map[string]string{
+			"preview": format.preview, "comments": format.comments, "one like": format.oneLike, "anonymous": format.anonymous,
+		} {
+			if label == "" || strings.Contains(label, "%") {
+				t.Errorf("%s %s label %q must be plain text", language, name, label)
+			}
+		}
+		for i, month := range format.months {
+			if month == "" {
+				t.Errorf("%s has no name for month %d", language, i+1)
+			}
+		}
+	}
+}
+
+func TestPreviewAndCommentsLocale(t *testing.T) {
+	article := &scraper.Article{
+		Title:     "Title",
+		URL:       "https://example.substack.com/p/title",
+		Truncated: true,
+		Comments: []*scraper.Comment{
+			{Author: "Jane", Body: "First", Likes: 1},
+			{Body: "Second", Likes: 3},
+		},
+	}
+	link := `<a href="https://example.substack.com/p/title">https://example.substack.com/p/title</a>`
+
+	tests := []struct {
+		locale  string
+		header  []string
+		title   string
+		comment []string
+	}{
+		{"en", []string{"<strong>Preview only:</strong>", "Read the full post at " + link + "."}, "Comments", []string{"1 like", "<strong>Anonymous</strong>", "3 likes"}},
+		{"de", []string{"<strong>Nur Vorschau:</strong>", "gibt es unter " + link + "."}, "Kommentare", []string{"1 Like", "<strong>Anonym</strong>", "3 Likes"}},
+		{"fr", []string{"<strong>Aperçu seulement\u00a0:</strong>", "sur " + link + "."}, "Commentaires", []string{"1 j’aime", "<strong>Anonyme</strong>", "3 j’aime"}},
+		{"sv-SE", []string{"<strong>Endast förhandsvisning:</strong>", "på " + link + "."}, "Kommentarer", []string{"1 gillning", "<strong>Anonym</strong>", "3 gillningar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			options := DefaultOptions()
+			options.Locale = tt.locale
+
+			header := articleHeader(article, options)
+			for _, want := range tt.header {
+				if !strings.Contains(header, want) {
+					t.Errorf("header lacks %q:\n%s", want, header)
+				}
+			}
+
+			if got := commentsChapterTitle(article, 1, options); got != tt.title {
+				t.Errorf("comments chapter is titled %q, want %q", got, tt.title)
+			}
+			if got := commentsChapterTitle(article, 2, options); got != tt.title+": Title" {
+				t.Errorf("comments chapter in a bundle is titled %q", got)
+			}
+			comments := commentsHTML(article.Comments, options)
+			for _, want := range append(tt.comment, "<h1>"+tt.title+"</h1>") {
+				if !strings.Contains(comments, want) {
+					t.Errorf("comments lack %q:\n%s", want, comments)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package converter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	r "github.com/leotaku/mobi/records"
+)
+
+// footnoteNumber matches the number at the end of Substack footnote ids
+var footnoteNumber = regexp.MustCompile(`(\d+)$`)
+
+// footnote is a Substack footnote found in the article content
+type footnote struct {
+	number  string
+	anchors *goquery.Selection
+	note    *goquery.Selection
+}
+
+// epubFootnotes turns Substack footnotes into EPUB3 noteref/footnote pairs,
+// which Kindle shows as pop-up footnotes
+func epubFootnotes(content string) string {
+	return rewriteFootnotes(content, func(fn footnote) {
+		fn.anchors.Each(func(i int, a *goquery.Selection) {
+			a.SetAttr("epub:type", "noteref")
+		})
+		fn.note.ReplaceWithHtml(fmt.Sprintf(`<aside epub:type="footnote" id="fn-%s" class="footnote">%s</aside>`,
+			fn.number, footnoteBody(fn)))
+	})
+}
+
+// mobiFootnotes turns Substack footnotes into plain links in both directions
+func mobiFootnotes(content string) string {
+	return rewriteFootnotes(content, func(fn footnote) {
+		fn.note.ReplaceWithHtml(fmt.Sprintf(`<div id="fn-%s" class="footnote">%s</div>`,
+			fn.number, footnoteBody(fn)))
+	})
+}
+
+// rewriteFootnotes finds Substack's footnote anchors and footnotes, points
+// them at each other with stable ids and lets format rewrite each footnote
+func rewriteFootnotes(content string, format func(fn footnote)) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	notes := doc.Find("div.footnote")
+	if notes.Length() == 0 {
+		return content
+	}
+
+	notes.Each(func(i int, note *goquery.Selection) {
+		numberLink := note.Find("a.footnote-number").First()
+		number := footnoteNumber.FindString(numberLink.AttrOr("id", ""))
+		if number == "" {
+			number = strings.TrimSpace(numberLink.Text())
+		}
+		if number == "" {
+			return
+		}
+
+		// Anchors may link with a bare fragment or the full post URL
+		anchors := doc.Find("a.footnote-anchor").FilterFunction(func(i int, a *goquery.Selection) bool {
+			return strings.HasSuffix(a.AttrOr("href", ""), "#footnote-"+number)
+		})
+		anchors.Each(func(i int, a *goquery.Selection) {
+			a.SetAttr("href", "#fn-"+number)
+			a.RemoveAttr("target")
+			if i == 0 {
+				a.SetAttr("id", "fnref-"+number)
+			} else {
+				a.RemoveAttr("id")
+			}
+			if goquery.NodeName(a.Parent()) != "sup" {
+				a.WrapHtml("<sup></sup>")
+			}
+		})
+
+		format(footnote{number: number, anchors: anchors, note: note})
+	})
+
+	result, err := doc.Find("body").Html()
+	if err != nil {
+		return content
+	}
+	return result
+}
+
+// footnoteBody renders the footnote text with a numbered link back to the anchor
+func footnoteBody(fn footnote) string {
+	body := fn.note.Find(".footnote-content").First()
+	if body.Length() == 0 {
+		body = fn.note
+		body.Find("a.footnote-number").Remove()
+	}
+
+	backLink := fmt.Sprintf(`<a href="#fnref-%s">%s.</a> `, fn.number, fn.number)
+	if first := body.Find("p").First(); first.Length() > 0 {
+		first.PrependHtml(backLink)
+		html, _ := body.Html()
+		return html
+	}
+
+	html, _ := body.Html()
+	return "<p>" + backLink + html + "</p>"
+}
+
+// mobiLinkPlaceholder is a fixed-width placeholder for a KF8 position link
+const mobiLinkPlaceholder = "kindle:pos:fid:????:off:??????????"
+
+var (
+	internalHref = regexp.MustCompile(`href="#([^"]+)"`)
+	elementID    = regexp.MustCompile(`\sid="([^"]+)"`)
+)
+
+// resolveMobiLinks rewrites links to #ids in KF8 chunk bodies into
+// kindle:pos links, which is the only form of internal link Kindle follows.
+// The positions are the chunk index and the byte offset of the target element.
+// Ids in the same body win over ids in other bodies, since every article of
+// a book numbers its footnotes from one.
+func resolveMobiLinks(bodies []string) []string {
+	// Swap links for same-length placeholders first, so offsets stay valid
+	targets := make([][]string, len(bodies))
+	for i, body := range bodies {
+		bodies[i] = internalHref.ReplaceAllStringFunc(body, func(match string) string {
+			id := internalHref.FindStringSubmatch(match)[1]
+			targets[i] = append(targets[i], id)
+			return `href="` + mobiLinkPlaceholder + `"`
+		})
+	}
+
+	// Find the position of every element with an id, per body and book-wide
+	positions := make(map[string]string)
+	local := make([]map[string]string, len(bodies))
+	for i, body := range bodies {
+		local[i] = make(map[string]string)
+		for _, match := range elementID.FindAllStringSubmatchIndex(body, -1) {
+			id := body[match[2]:match[3]]
+			start := strings.LastIndex(body[:match[0]], "<")
+			if _, exists := local[i][id]; exists || start < 0 {
+				continue
+			}
+			position := fmt.Sprintf("kindle:pos:fid:%s:off:%010s", r.To32(i), strings.ToUpper(strconv.FormatInt(int64(start), 32)))
+			local[i][id] = position
+			if _, exists := positions[id]; !exists {
+				positions[id] = position
+			}
+		}
+	}
+
+	// Fill in the placeholders, leaving links to missing targets as they were
+	for i := range bodies {
+		for _, id := range targets[i] {
+			position, ok := local[i][id]
+			if !ok {
+				position, ok = positions[id]
+			}
+			if !ok {
+				position = "#" + id
+			}
+			bodies[i] = strings.Replace(bodies[i], mobiLinkPlaceholder, position, 1)
+		}
+	}
+
+	return bodies
+}
@@ -0,0 +1,144 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// MathImageURL is the service that renders TeX to PNG images for the Kindle
+// formats, which cannot show MathML. %s is replaced by the encoded TeX. It is
+// only used with ConversionOptions.RenderMathImages, since it sends the
+// formulas of the article to a third party.
+var MathImageURL = "https://latex.codecogs.com/png.image?%s"
+
+// formula is a TeX formula found in the article content
+type formula struct {
+	tex     string
+	display bool
+	// mathML is the MathML KaTeX rendered next to the formula, if any
+	mathML *goquery.Selection
+}
+
+// epubMath replaces LaTeX blocks and KaTeX markup with MathML, keeping the
+// TeX as alt text. It reports whether the content contains any math.
+func epubMath(content string) (string, bool) {
+	found := false
+	result := rewriteMath(content, func(f formula) string {
+		found = true
+		var math string
+		if f.mathML != nil && f.mathML.Length() > 0 {
+			f.mathML.SetAttr("xmlns", mathMLNamespace)
+			f.mathML.SetAttr("alttext", f.tex)
+			if f.display {
+				f.mathML.SetAttr("display", "block")
+			}
+			math, _ = goquery.OuterHtml(f.mathML)
+		} else {
+			math = texToMathML(f.tex, f.display)
+		}
+
+		if f.display {
+			return `<div class="math">` + math + "</div>"
+		}
+		return math
+	})
+	return result, found
+}
+
+// mobiMath replaces LaTeX blocks and KaTeX markup for the Kindle formats.
+// With renderImages, formulas become images rendered by MathImageURL, with
+// the TeX as alt text, and the image URLs to download are returned;
+// otherwise they are shown as TeX.
+func mobiMath(content string, renderImages bool) (string, []string) {
+	var imageURLs []string
+	result := rewriteMath(content, func(f formula) string {
+		var math string
+		if renderImages {
+			query := url.QueryEscape(`\dpi{300}` + f.tex)
+			imageURL := fmt.Sprintf(MathImageURL, strings.ReplaceAll(query, "+", "%20"))
+			imageURLs = append(imageURLs, imageURL)
+			math = fmt.Sprintf(`<img class="math" src="%s" alt="%s"/>`, html.EscapeString(imageURL), html.EscapeString(f.tex))
+		} else {
+			math = "<code>" + html.EscapeString(f.tex) + "</code>"
+		}
+
+		if f.display {
+			return `<div class="math">` + math + "</div>"
+		}
+		return math
+	})
+	return result, imageURLs
+}
+
+// rewriteMath finds Substack's LaTeX blocks and KaTeX-rendered formulas and
+// replaces each with the HTML returned by render
+func rewriteMath(content string, render func(f formula) string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	changed := false
+	replace := func(s *goquery.Selection, display bool) {
+		f := formula{
+			tex:     formulaTeX(s),
+			display: display,
+			mathML:  s.Find(".katex-mathml math").First(),
+		}
+		if f.tex == "" {
+			return
+		}
+		s.ReplaceWithHtml(render(f))
+		changed = true
+	}
+
+	doc.Find(".latex-rendered, [data-component-name='LatexBlockToDOM']").Each(func(i int, s *goquery.Selection) {
+		replace(s, true)
+	})
+	doc.Find(".katex-display").Each(func(i int, s *goquery.Selection) {
+		replace(s, true)
+	})
+	doc.Find(".katex").Each(func(i int, s *goquery.Selection) {
+		replace(s, false)
+	})
+
+	if !changed {
+		return content
+	}
+	result, err := doc.Find("body").Html()
+	if err != nil {
+		return content
+	}
+	return result
+}
+
+// formulaTeX returns the TeX source of a formula from Substack's data
+// attributes, the TeX annotation KaTeX keeps, or the unrendered text
+func formulaTeX(s *goquery.Selection) string {
+	var data struct {
+		PersistentExpression string `json:"persistentExpression"`
+		Expression           string `json:"expression"`
+	}
+	if raw, ok := s.Attr("data-attrs"); ok && json.Unmarshal([]byte(raw), &data) == nil {
+		for _, tex := range []string{data.PersistentExpression, data.Expression} {
+			if tex = strings.TrimSpace(tex); tex != "" {
+				return tex
+			}
+		}
+	}
+
+	if annotation := s.Find("annotation[encoding='application/x-tex']").First(); annotation.Length() > 0 {
+		return strings.TrimSpace(annotation.Text())
+	}
+
+	// Blocks that were never rendered hold the TeX as text
+	if s.Find(".katex").Length() == 0 {
+		return strings.TrimSpace(s.Text())
+	}
+	return ""
+}
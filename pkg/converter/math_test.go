@@ -0,0 +1,27 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMobiMath(t *testing.T) {
+	content := `<p>Euler: <span class="latex-rendered" data-attrs="{&quot;persistentExpression&quot;:&quot;e^{i\\pi} + 1 = 0&quot;}"></span></p>`
+
+	// Without the option, the formula never leaves the machine
+	local, imageURLs := mobiMath(content, false)
+	if len(imageURLs) != 0 {
+		t.Errorf("mobiMath without images returned URLs %v", imageURLs)
+	}
+	if want := `<div class="math"><code>e^{i\pi} + 1 = 0</code></div>`; !strings.Contains(local, want) {
+		t.Errorf("mobiMath without images = %s, want the TeX in %s", local, want)
+	}
+
+	rendered, imageURLs := mobiMath(content, true)
+	if len(imageURLs) != 1 || !strings.HasPrefix(imageURLs[0], "https://latex.codecogs.com/png.image?") {
+		t.Fatalf("mobiMath with images returned URLs %v, want one CodeCogs URL", imageURLs)
+	}
+	if !strings.Contains(rendered, `<img class="math" src="`) || !strings.Contains(rendered, `alt="e^{i\pi} + 1 = 0"`) {
+		t.Errorf("mobiMath with images = %s, want an image with the TeX as alt text", rendered)
+	}
+}
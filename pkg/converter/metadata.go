@@ -0,0 +1,270 @@
+package converter
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	_ "image/gif"  // register GIF decoder for cover images
+	_ "image/jpeg" // register JPEG decoder for cover images
+	_ "image/png"  // register PNG decoder for cover images
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"substack-to-kindle/pkg/scraper"
+
+	"golang.org/x/text/language"
+)
+
+// packageDocumentPath is where go-epub stores the package document
+const packageDocumentPath = "EPUB/package.opf"
+
+// articleHeader renders the title block shown at the top of an article
+func articleHeader(article *scraper.Article, options *ConversionOptions) string {
+	var b strings.Builder
+	locale := localeOf(options)
+
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(article.Title))
+	if article.Subtitle != "" {
+		fmt.Fprintf(&b, "<p class=\"subtitle\"><em>%s</em></p>\n", html.EscapeString(article.Subtitle))
+	}
+	fmt.Fprintf(&b, "<p><strong>%s</strong></p>\n", fmt.Sprintf(locale.byline, html.EscapeString(article.Author)))
+
+	var publication []string
+	for _, part := range []string{article.Publication, article.Section} {
+		if part != "" {
+			publication = append(publication, html.EscapeString(part))
+		}
+	}
+	if len(publication) > 0 {
+		fmt.Fprintf(&b, "<p><em>%s</em></p>\n", strings.Join(publication, " · "))
+	}
+
+	// Leave out dates the scraper could not find instead of showing year 1
+	published := ""
+	if !article.PublishedAt.IsZero() {
+		published = formatDate(article.PublishedAt, options)
+		fmt.Fprintf(&b, "<p><em>%s</em></p>\n", fmt.Sprintf(locale.published, published))
+	}
+	if !article.UpdatedAt.IsZero() {
+		if updated := formatDate(article.UpdatedAt, options); updated != published {
+			fmt.Fprintf(&b, "<p><em>%s</em></p>\n", fmt.Sprintf(locale.updated, updated))
+		}
+	}
+	link := fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(article.URL), html.EscapeString(article.URL))
+	fmt.Fprintf(&b, "<p><em>%s</em></p>\n", fmt.Sprintf(locale.source, link))
+	if article.Truncated {
+		fmt.Fprintf(&b, "<p class=\"preview-notice\"><strong>%s</strong> %s</p>\n", locale.preview, fmt.Sprintf(locale.previewNotice, link))
+	}
+	b.WriteString("<hr/>\n")
+
+	return b.String()
+}
+
+// bookAuthors returns the article authors, falling back to the display author
+func bookAuthors(article *scraper.Article) []string {
+	if len(article.Authors) > 0 {
+		return article.Authors
+	}
+	return []string{article.Author}
+}
+
+// bookDescription returns the description, falling back to the subtitle
+func bookDescription(article *scraper.Article) string {
+	if article.Description != "" {
+		return article.Description
+	}
+	return article.Subtitle
+}
+
+// bookLanguage parses the article language, defaulting to English
+func bookLanguage(article *scraper.Article) language.Tag {
+	if article.Language != "" {
+		if tag, err := language.Parse(article.Language); err == nil {
+			return tag
+		}
+	}
+	return language.English
+}
+
+// bookSubject joins the section and tags for formats with a single subject field
+func bookSubject(article *scraper.Article) string {
+	var subjects []string
+	if article.Section != "" {
+		subjects = append(subjects, article.Section)
+	}
+	subjects = append(subjects, article.Tags...)
+	return strings.Join(subjects, "; ")
+}
+
+// loadImage decodes a downloaded JPEG, PNG or GIF image. Transparent areas
+// are made white, since Kindle formats store every image as a JPEG.
+func loadImage(imagePath string) (image.Image, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	flattened := image.NewRGBA(img.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flattened, nil
+}
+
+// packageMetadata renders the metadata elements go-epub has no setters for:
+// co-authors, subtitle, publisher, dates, section and tags
+func packageMetadata(article *scraper.Article) string {
+	var b strings.Builder
+
+	authors := bookAuthors(article)
+	for i, author := range authors {
+		// go-epub already wrote the first author
+		if i == 0 {
+			continue
+		}
+		id := fmt.Sprintf("creator%d", i+1)
+		fmt.Fprintf(&b, "    <dc:creator id=\"%s\">%s</dc:creator>\n", id, html.EscapeString(author))
+		fmt.Fprintf(&b, "    <meta refines=\"#%s\" property=\"role\" scheme=\"marc:relators\">aut</meta>\n", id)
+	}
+
+	if article.Subtitle != "" {
+		fmt.Fprintf(&b, "    <dc:title id=\"subtitle\">%s</dc:title>\n", html.EscapeString(article.Subtitle))
+		b.WriteString("    <meta refines=\"#subtitle\" property=\"title-type\">subtitle</meta>\n")
+	}
+	if article.Publication != "" {
+		fmt.Fprintf(&b, "    <dc:publisher>%s</dc:publisher>\n", html.EscapeString(article.Publication))
+	}
+	if !article.PublishedAt.IsZero() {
+		fmt.Fprintf(&b, "    <dc:date>%s</dc:date>\n", article.PublishedAt.UTC().Format(time.RFC3339))
+	}
+	if article.URL != "" {
+		fmt.Fprintf(&b, "    <dc:source>%s</dc:source>\n", html.EscapeString(article.URL))
+	}
+	if article.Section != "" {
+		fmt.Fprintf(&b, "    <meta property=\"belongs-to-collection\" id=\"section\">%s</meta>\n", html.EscapeString(article.Section))
+	}
+	for _, tag := range article.Tags {
+		fmt.Fprintf(&b, "    <dc:subject>%s</dc:subject>\n", html.EscapeString(tag))
+	}
+
+	return b.String()
+}
+
+// addPackageMetadata rewrites the package document of an EPUB to include
+// the metadata that go-epub cannot set
+func addPackageMetadata(epubPath string, article *scraper.Article) error {
+	extra := packageMetadata(article)
+	modified := ""
+	if !article.UpdatedAt.IsZero() {
+		modified = article.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	if extra == "" && modified == "" {
+		return nil
+	}
+
+	return rewriteEPUBFile(epubPath, packageDocumentPath, func(opf string) string {
+		if modified != "" {
+			opf = replaceElementText(opf, `<meta property="dcterms:modified">`, "</meta>", modified)
+		}
+		// Insert at the start of the line holding the closing tag
+		end := strings.Index(opf, "</metadata>")
+		if end < 0 {
+			return opf
+		}
+		lineStart := strings.LastIndex(opf[:end], "\n") + 1
+		return opf[:lineStart] + extra + opf[lineStart:]
+	})
+}
+
+// addManifestProperty adds a property such as "mathml" to the manifest item
+// of a section, which go-epub cannot set
+func addManifestProperty(epubPath, sectionPath, property string) error {
+	id := fmt.Sprintf("id=\"%s\"", path.Base(sectionPath))
+	return rewriteEPUBFile(epubPath, packageDocumentPath, func(opf string) string {
+		return strings.Replace(opf, id, fmt.Sprintf("%s properties=\"%s\"", id, property), 1)
+	})
+}
+
+// replaceElementText replaces the text between an opening tag and its closing tag
+func replaceElementText(doc, open, close, text string) string {
+	start := strings.Index(doc, open)
+	if start < 0 {
+		return doc
+	}
+	start += len(open)
+	end := strings.Index(doc[start:], close)
+	if end < 0 {
+		return doc
+	}
+	return doc[:start] + text + doc[start+end:]
+}
+
+// rewriteEPUBFile replaces one file inside an EPUB archive. Every other
+// entry is copied as is, which keeps the uncompressed mimetype entry first.
+func rewriteEPUBFile(epubPath, name string, rewrite func(string) string) error {
+	reader, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return fmt.Errorf("failed to open EPUB: %w", err)
+	}
+	defer reader.Close()
+
+	tempPath := epubPath + ".tmp"
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create EPUB: %w", err)
+	}
+	defer os.Remove(tempPath)
+
+	writer := zip.NewWriter(out)
+	for _, file := range reader.File {
+		if file.Name != name {
+			if err := writer.Copy(file); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to copy %s: %w", file.Name, err)
+			}
+			continue
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to read %s: %w", file.Name, err)
+		}
+		content, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to read %s: %w", file.Name, err)
+		}
+
+		dst, err := writer.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: file.Modified})
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+		if _, err := io.WriteString(dst, rewrite(string(content))); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to finish EPUB: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to finish EPUB: %w", err)
+	}
+
+	return os.Rename(tempPath, epubPath)
+}
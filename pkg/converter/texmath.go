@@ -0,0 +1,402 @@
+package converter
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// mathMLNamespace is the namespace of MathML elements
+const mathMLNamespace = "http://www.w3.org/1998/Math/MathML"
+
+// texIdentifiers maps TeX commands to the characters they stand for as identifiers
+var texIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ",
+	"varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "ell": "ℓ", "hbar": "ℏ", "emptyset": "∅",
+	"aleph": "ℵ", "Re": "ℜ", "Im": "ℑ",
+}
+
+// texOperators maps TeX commands to the characters they stand for as operators
+var texOperators = map[string]string{
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "∙", "cdots": "⋯", "ldots": "…", "dots": "…", "vdots": "⋮", "ddots": "⋱",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝", "ll": "≪", "gg": "≫",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "supset": "⊃", "subseteq": "⊆",
+	"supseteq": "⊇", "cup": "∪", "cap": "∩", "setminus": "∖", "land": "∧", "wedge": "∧",
+	"lor": "∨", "vee": "∨", "neg": "¬", "lnot": "¬", "forall": "∀", "exists": "∃",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "leftrightarrow": "↔", "Rightarrow": "⇒",
+	"Leftarrow": "⇐", "Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺", "mapsto": "↦",
+	"mid": "∣", "parallel": "∥", "perp": "⊥", "angle": "∠", "oplus": "⊕", "otimes": "⊗",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"vert": "|", "Vert": "‖", "lbrace": "{", "rbrace": "}", "{": "{", "}": "}", "|": "‖",
+	"%": "%", "#": "#", "&": "&", "$": "$", "_": "_",
+}
+
+// texLargeOperators are operators whose limits go above and below in display math
+var texLargeOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂",
+	"int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+}
+
+// texFunctions are operator names written upright
+var texFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "lim": true, "liminf": true, "limsup": true,
+	"max": true, "min": true, "sup": true, "inf": true, "det": true, "dim": true, "ker": true,
+	"deg": true, "gcd": true, "arg": true, "Pr": true,
+}
+
+// texAccents maps accent commands to the character drawn over their argument
+var texAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "¯", "vec": "→", "overrightarrow": "→",
+	"tilde": "~", "widetilde": "~", "dot": "˙", "ddot": "¨",
+}
+
+// texFonts maps font commands to MathML math variants
+var texFonts = map[string]string{
+	"mathbf": "bold", "boldsymbol": "bold-italic", "mathit": "italic", "mathrm": "normal",
+	"mathbb": "double-struck", "mathcal": "script", "mathscr": "script", "mathfrak": "fraktur",
+	"mathsf": "sans-serif", "mathtt": "monospace",
+}
+
+// texSpaces maps spacing commands to widths
+var texSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ">": "0.222em", ";": "0.278em", " ": "0.333em",
+	"quad": "1em", "qquad": "2em", "!": "-0.167em",
+}
+
+// texEnvironments maps matrix environments to the fences around them
+var texEnvironments = map[string][2]string{
+	"matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"}, "Bmatrix": {"{", "}"},
+	"vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"}, "cases": {"{", ""}, "aligned": {"", ""},
+	"align": {"", ""}, "align*": {"", ""}, "gathered": {"", ""}, "array": {"", ""},
+}
+
+// texToMathML converts a TeX math expression to MathML. It covers the
+// notation common in articles: scripts, fractions, roots, Greek letters,
+// operators, fences, fonts, accents and matrices. Commands it does not know
+// are kept as text, and the TeX source is kept as an annotation.
+func texToMathML(tex string, display bool) string {
+	p := &texParser{tokens: tokenizeTeX(tex), display: display}
+	body := p.parseRow(nil)
+
+	mode := "inline"
+	if display {
+		mode = "block"
+	}
+	escaped := html.EscapeString(tex)
+	return fmt.Sprintf(`<math xmlns="%s" display="%s" alttext="%s"><semantics><mrow>%s</mrow><annotation encoding="application/x-tex">%s</annotation></semantics></math>`,
+		mathMLNamespace, mode, escaped, body, escaped)
+}
+
+// texToken is a command (with its leading backslash), a character or a number
+type texToken string
+
+// tokenizeTeX splits TeX source into commands, numbers and single characters
+func tokenizeTeX(tex string) []texToken {
+	var tokens []texToken
+	runes := []rune(tex)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			// Spaces only matter inside \text, so runs collapse to one token
+			if len(tokens) > 0 && tokens[len(tokens)-1] != " " {
+				tokens = append(tokens, " ")
+			}
+		case r == '\\' && i+1 < len(runes):
+			j := i + 1
+			for j < len(runes) && unicode.IsLetter(runes[j]) {
+				j++
+			}
+			if j == i+1 {
+				j++ // a single non-letter command such as \, or \\
+			} else if j < len(runes) && runes[j] == '*' {
+				j++
+			}
+			tokens = append(tokens, texToken(runes[i:j]))
+			i = j - 1
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || (runes[j] == '.' && j+1 < len(runes) && unicode.IsDigit(runes[j+1]))) {
+				j++
+			}
+			tokens = append(tokens, texToken(runes[i:j]))
+			i = j - 1
+		default:
+			tokens = append(tokens, texToken(string(r)))
+		}
+	}
+	return tokens
+}
+
+// texParser is a recursive descent parser over TeX tokens
+type texParser struct {
+	tokens  []texToken
+	pos     int
+	display bool
+}
+
+// peek returns the next token without consuming it, skipping spaces
+func (p *texParser) peek() texToken {
+	for p.pos < len(p.tokens) && p.tokens[p.pos] == " " {
+		p.pos++
+	}
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// next consumes and returns the next token
+func (p *texParser) next() texToken {
+	token := p.peek()
+	if token != "" {
+		p.pos++
+	}
+	return token
+}
+
+// parseRow parses atoms until the end of input or one of the stop tokens
+func (p *texParser) parseRow(stop map[texToken]bool) string {
+	var b strings.Builder
+	for {
+		token := p.peek()
+		if token == "" || stop[token] {
+			return b.String()
+		}
+		b.WriteString(p.parseScripted())
+	}
+}
+
+// parseGroup parses a braced group, or a single atom when there are no
+// braces. A missing argument becomes an empty row, so the element it
+// belongs to keeps the number of children MathML requires.
+func (p *texParser) parseGroup() string {
+	token := p.peek()
+	if token == "{" {
+		p.next()
+		row := p.parseRow(map[texToken]bool{"}": true})
+		p.next()
+		return "<mrow>" + row + "</mrow>"
+	}
+
+	// Only the first digit of a number is an argument, as in \frac12
+	if len(token) > 1 && unicode.IsDigit(rune(token[0])) {
+		p.tokens[p.pos] = token[1:]
+		return "<mn>" + string(token[:1]) + "</mn>"
+	}
+
+	if atom := p.parseAtom(); atom != "" {
+		return atom
+	}
+	return "<mrow></mrow>"
+}
+
+// parseRawGroup returns the unparsed text of a braced group, for \text and environment names
+func (p *texParser) parseRawGroup() string {
+	if p.peek() != "{" {
+		return string(p.next())
+	}
+	p.next()
+	var parts []string
+	for depth := 1; p.pos < len(p.tokens); {
+		token := p.tokens[p.pos]
+		p.pos++
+		if token == "{" {
+			depth++
+		} else if token == "}" {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+		parts = append(parts, strings.TrimPrefix(string(token), "\\"))
+	}
+	return strings.Join(parts, "")
+}
+
+// parseScripted parses an atom with its superscript, subscript and primes
+func (p *texParser) parseScripted() string {
+	start := p.peek()
+	base := p.parseAtom()
+
+	for p.peek() == "'" {
+		p.next()
+		base = "<msup>" + base + "<mo>′</mo></msup>"
+	}
+
+	var sub, sup string
+	if (p.peek() == "_" || p.peek() == "^") && base == "" {
+		base = "<mrow></mrow>"
+	}
+	for p.peek() == "_" || p.peek() == "^" {
+		if p.next() == "_" {
+			sub = p.parseGroup()
+		} else {
+			sup = p.parseGroup()
+		}
+	}
+
+	// Sums, products and limits take their limits above and below in display math
+	name := strings.TrimPrefix(string(start), "\\")
+	_, large := texLargeOperators[name]
+	under := p.display && ((large && !strings.Contains(name, "int")) || name == "lim" || name == "max" || name == "min")
+	switch {
+	case sub != "" && sup != "" && under:
+		return "<munderover>" + base + sub + sup + "</munderover>"
+	case sub != "" && sup != "":
+		return "<msubsup>" + base + sub + sup + "</msubsup>"
+	case sub != "" && under:
+		return "<munder>" + base + sub + "</munder>"
+	case sub != "":
+		return "<msub>" + base + sub + "</msub>"
+	case sup != "":
+		return "<msup>" + base + sup + "</msup>"
+	}
+	return base
+}
+
+// parseAtom parses a single character, number, group or command
+func (p *texParser) parseAtom() string {
+	token := p.next()
+	switch {
+	case token == "":
+		return ""
+	case token == "{":
+		p.pos--
+		return p.parseGroup()
+	case token == "}":
+		return ""
+	case unicode.IsDigit([]rune(token)[0]):
+		return "<mn>" + string(token) + "</mn>"
+	case unicode.IsLetter([]rune(token)[0]):
+		return "<mi>" + html.EscapeString(string(token)) + "</mi>"
+	case token == "~":
+		return `<mspace width="0.333em"/>`
+	case strings.HasPrefix(string(token), "\\"):
+		return p.parseCommand(strings.TrimPrefix(string(token), "\\"))
+	}
+	return "<mo>" + html.EscapeString(string(token)) + "</mo>"
+}
+
+// parseCommand parses a command and its arguments
+func (p *texParser) parseCommand(name string) string {
+	if symbol, ok := texIdentifiers[name]; ok {
+		return "<mi>" + symbol + "</mi>"
+	}
+	if symbol, ok := texOperators[name]; ok {
+		return "<mo>" + html.EscapeString(symbol) + "</mo>"
+	}
+	if symbol, ok := texLargeOperators[name]; ok {
+		return `<mo largeop="true">` + symbol + "</mo>"
+	}
+	if texFunctions[name] {
+		return `<mi mathvariant="normal">` + name + "</mi>"
+	}
+	if width, ok := texSpaces[name]; ok {
+		return `<mspace width="` + width + `"/>`
+	}
+	if accent, ok := texAccents[name]; ok {
+		return `<mover accent="true">` + p.parseGroup() + "<mo>" + accent + "</mo></mover>"
+	}
+	if variant, ok := texFonts[name]; ok {
+		return `<mstyle mathvariant="` + variant + `">` + p.parseGroup() + "</mstyle>"
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		numerator := p.parseGroup()
+		return "<mfrac>" + numerator + p.parseGroup() + "</mfrac>"
+	case "binom":
+		top := p.parseGroup()
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + top + p.parseGroup() + "</mfrac><mo>)</mo></mrow>"
+	case "sqrt":
+		if p.peek() == "[" {
+			p.next()
+			index := p.parseRow(map[texToken]bool{"]": true})
+			p.next()
+			return "<mroot>" + p.parseGroup() + "<mrow>" + index + "</mrow></mroot>"
+		}
+		return "<msqrt>" + p.parseGroup() + "</msqrt>"
+	case "text", "textrm", "textit", "textbf", "mbox", "operatorname":
+		text := html.EscapeString(p.parseRawGroup())
+		if name == "operatorname" {
+			return `<mi mathvariant="normal">` + text + "</mi>"
+		}
+		return "<mtext>" + text + "</mtext>"
+	case "left", "bigl", "Bigl", "biggl", "Biggl":
+		open := p.fence()
+		row := p.parseRow(map[texToken]bool{"\\right": true, "\\bigr": true, "\\Bigr": true, "\\biggr": true, "\\Biggr": true})
+		p.next()
+		return "<mrow>" + open + row + p.fence() + "</mrow>"
+	case "right", "big", "Big", "bigg", "Bigg", "bigr", "Bigr", "biggr", "Biggr", "middle":
+		return p.fence()
+	case "begin":
+		return p.parseEnvironment(p.parseRawGroup())
+	case "\\":
+		return `<mspace linebreak="newline"/>`
+	case "displaystyle", "textstyle", "limits", "nolimits":
+		return ""
+	}
+
+	return "<mtext>\\" + html.EscapeString(name) + "</mtext>"
+}
+
+// fence parses the delimiter after \left, \right or \big
+func (p *texParser) fence() string {
+	token := strings.TrimPrefix(string(p.next()), "\\")
+	if token == "." || token == "" {
+		return ""
+	}
+	if symbol, ok := texOperators[token]; ok {
+		token = symbol
+	}
+	return `<mo fence="true">` + html.EscapeString(token) + "</mo>"
+}
+
+// parseEnvironment parses a matrix-like environment into a table
+func (p *texParser) parseEnvironment(name string) string {
+	fences := texEnvironments[name]
+	if name == "array" && p.peek() == "{" {
+		p.parseRawGroup() // column alignment
+	}
+
+	stop := map[texToken]bool{"&": true, "\\\\": true, "\\end": true}
+	var b strings.Builder
+	b.WriteString("<mtable><mtr><mtd>")
+	for {
+		b.WriteString(p.parseRow(stop))
+		token := p.next()
+		if token == "&" {
+			b.WriteString("</mtd><mtd>")
+			continue
+		}
+		if token == "\\\\" {
+			b.WriteString("</mtd></mtr><mtr><mtd>")
+			continue
+		}
+		if token == "\\end" {
+			p.parseRawGroup()
+		}
+		break
+	}
+	b.WriteString("</mtd></mtr></mtable>")
+
+	table := b.String()
+	if fences[0] != "" {
+		table = `<mo fence="true">` + fences[0] + "</mo>" + table
+	}
+	if fences[1] != "" {
+		table += `<mo fence="true">` + fences[1] + "</mo>"
+	}
+	return "<mrow>" + table + "</mrow>"
+}
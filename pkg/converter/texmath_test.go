@@ -0,0 +1,171 @@
+package converter
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// mathMLBody returns the MathML of the formula inside the <semantics> wrapper
+func mathMLBody(t *testing.T, tex string, display bool) string {
+	t.Helper()
+	out := texToMathML(tex, display)
+	start := strings.Index(out, "<semantics><mrow>")
+	end := strings.LastIndex(out, "</mrow><annotation")
+	if start < 0 || end < start {
+		t.Fatalf("texToMathML(%q) has no semantics wrapper: %s", tex, out)
+	}
+	return out[start+len("<semantics><mrow>") : end]
+}
+
+func TestTeXToMathML(t *testing.T) {
+	tests := []struct {
+		name    string
+		tex     string
+		display bool
+		want    string
+	}{
+		// Fractions
+		{"fraction", `\frac{a}{b}`, false, `<mfrac><mrow><mi>a</mi></mrow><mrow><mi>b</mi></mrow></mfrac>`},
+		{"fraction of digits", `\frac12`, false, `<mfrac><mn>1</mn><mn>2</mn></mfrac>`},
+		{"fraction of a digit and a group", `\frac1{x}`, false, `<mfrac><mn>1</mn><mrow><mi>x</mi></mrow></mfrac>`},
+		{"display fraction", `\dfrac{x+1}{2}`, false, `<mfrac><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow><mrow><mn>2</mn></mrow></mfrac>`},
+		{"binomial", `\binom{n}{k}`, false, `<mrow><mo>(</mo><mfrac linethickness="0"><mrow><mi>n</mi></mrow><mrow><mi>k</mi></mrow></mfrac><mo>)</mo></mrow>`},
+
+		// Scripts
+		{"superscript", `x^2`, false, `<msup><mi>x</mi><mn>2</mn></msup>`},
+		{"superscript of a digit", `x^23`, false, `<msup><mi>x</mi><mn>2</mn></msup><mn>3</mn>`},
+		{"subscript", `x_i`, false, `<msub><mi>x</mi><mi>i</mi></msub>`},
+		{"sub and superscript", `x_i^2`, false, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{"super and subscript", `x^2_i`, false, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{"grouped subscript", `a_{ij}`, false, `<msub><mi>a</mi><mrow><mi>i</mi><mi>j</mi></mrow></msub>`},
+		{"prime", `f'(x)`, false, `<msup><mi>f</mi><mo>′</mo></msup><mo>(</mo><mi>x</mi><mo>)</mo>`},
+		{"inline sum", `\sum_{i=1}^n i`, false, `<msubsup><mo largeop="true">∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></msubsup><mi>i</mi>`},
+		{"display sum", `\sum_{i=1}^n i`, true, `<munderover><mo largeop="true">∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover><mi>i</mi>`},
+		{"display limit", `\lim_{x\to 0}`, true, `<munder><mi mathvariant="normal">lim</mi><mrow><mi>x</mi><mo>→</mo><mn>0</mn></mrow></munder>`},
+		{"display integral", `\int_0^1`, true, `<msubsup><mo largeop="true">∫</mo><mn>0</mn><mn>1</mn></msubsup>`},
+
+		// Roots
+		{"square root", `\sqrt{2}`, false, `<msqrt><mrow><mn>2</mn></mrow></msqrt>`},
+		{"square root of an atom", `\sqrt x`, false, `<msqrt><mi>x</mi></msqrt>`},
+		{"cube root", `\sqrt[3]{x}`, false, `<mroot><mrow><mi>x</mi></mrow><mrow><mn>3</mn></mrow></mroot>`},
+
+		// Environments
+		{"pmatrix", `\begin{pmatrix}a & b \\ c & d\end{pmatrix}`, true,
+			`<mrow><mo fence="true">(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo fence="true">)</mo></mrow>`},
+		{"cases", `\begin{cases} 1 & x > 0 \\ 0 & \text{otherwise}\end{cases}`, true,
+			`<mrow><mo fence="true">{</mo><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mi>x</mi><mo>&gt;</mo><mn>0</mn></mtd></mtr><mtr><mtd><mn>0</mn></mtd><mtd><mtext>otherwise</mtext></mtd></mtr></mtable></mrow>`},
+		{"array skips the column spec", `\begin{array}{cc}1&2\end{array}`, true,
+			`<mrow><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mn>2</mn></mtd></mtr></mtable></mrow>`},
+
+		// Symbols, fences, fonts and text
+		{"greek and operators", `\alpha + \beta \leq \infty`, false, `<mi>α</mi><mo>+</mo><mi>β</mi><mo>≤</mo><mi>∞</mi>`},
+		{"fences", `\left( \frac{a}{b} \right)`, false, `<mrow><mo fence="true">(</mo><mfrac><mrow><mi>a</mi></mrow><mrow><mi>b</mi></mrow></mfrac><mo fence="true">)</mo></mrow>`},
+		{"font", `\mathbb{R}`, false, `<mstyle mathvariant="double-struck"><mrow><mi>R</mi></mrow></mstyle>`},
+		{"accent", `\hat{x}`, false, `<mover accent="true"><mrow><mi>x</mi></mrow><mo>^</mo></mover>`},
+		{"function", `\sin x`, false, `<mi mathvariant="normal">sin</mi><mi>x</mi>`},
+		{"text keeps spaces", `\text{if } x < y`, false, `<mtext>if </mtext><mi>x</mi><mo>&lt;</mo><mi>y</mi>`},
+		{"decimal", `3.14`, false, `<mn>3.14</mn>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mathMLBody(t, tt.tex, tt.display); got != tt.want {
+				t.Errorf("texToMathML(%q)\n got: %s\nwant: %s", tt.tex, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTeXToMathMLKeepsSource(t *testing.T) {
+	tex := `a < b \text{ & } c`
+	out := texToMathML(tex, true)
+	for _, want := range []string{
+		`display="block"`,
+		`alttext="a &lt; b \text{ &amp; } c"`,
+		`<annotation encoding="application/x-tex">a &lt; b \text{ &amp; } c</annotation>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("texToMathML(%q) lacks %s: %s", tex, want, out)
+		}
+	}
+}
+
+// mathMLArity is the number of children MathML elements must have
+var mathMLArity = map[string]int{
+	"mfrac": 2, "mroot": 2, "msup": 2, "msub": 2, "munder": 2, "mover": 2,
+	"msubsup": 3, "munderover": 3,
+}
+
+// checkMathML reports whether MathML is well-formed and every element has
+// the number of children it needs
+func checkMathML(mathML string) error {
+	decoder := xml.NewDecoder(strings.NewReader(mathML))
+	type element struct {
+		name     string
+		children int
+	}
+	var stack []*element
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if len(stack) > 0 {
+				stack[len(stack)-1].children++
+			}
+			stack = append(stack, &element{name: token.Name.Local})
+		case xml.EndElement:
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if want, ok := mathMLArity[top.name]; ok && top.children != want {
+				return fmt.Errorf("<%s> has %d children, want %d", top.name, top.children, want)
+			}
+		}
+	}
+}
+
+func TestTeXToMathMLBadInput(t *testing.T) {
+	for _, tex := range []string{
+		``,
+		`{x`,
+		`x}`,
+		`}}{{`,
+		`\frac{1}`,
+		`\frac`,
+		`x^`,
+		`x_`,
+		`^2`,
+		`x^{`,
+		`\sqrt`,
+		`\sqrt[`,
+		`\sqrt[3`,
+		`\left(x`,
+		`\right)`,
+		`\left`,
+		`\begin{pmatrix}1 & 2`,
+		`\begin{unknown}a\end{unknown}`,
+		`\end{pmatrix}`,
+		`\begin`,
+		`\text{unclosed`,
+		`\foo{1}`,
+		`\`,
+		`\\`,
+		`a & b`,
+		`<script>alert(1)</script>`,
+	} {
+		for _, display := range []bool{false, true} {
+			out := texToMathML(tex, display)
+			if err := checkMathML(out); err != nil {
+				t.Errorf("texToMathML(%q, %v) is invalid: %v\n%s", tex, display, err, out)
+			}
+		}
+	}
+}
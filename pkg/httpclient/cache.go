@@ -0,0 +1,336 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotCached is returned in offline mode for requests the cache cannot answer
+var ErrNotCached = errors.New("not in the cache and offline mode is on")
+
+// DefaultCacheSize is the default limit of the cache in bytes
+const DefaultCacheSize = 500 << 20
+
+// DefaultCacheDir returns the cache directory inside the user's cache
+// directory, e.g. ~/.cache/substack-to-kindle on Linux
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "substack-to-kindle"), nil
+}
+
+// cache is a RoundTripper that keeps successful GET responses and permanent
+// redirects on disk. Responses that are still fresh by their Cache-Control
+// header are served from disk; stale ones are revalidated with their ETag or
+// Last-Modified date. The least recently used entries are removed once the
+// cache grows past its size limit.
+//
+// It is a private cache for one user, so responses marked private or
+// no-store are kept as well; when online, they are always revalidated.
+type cache struct {
+	base    http.RoundTripper
+	dir     string
+	maxSize int64
+	offline bool
+	// mu serializes eviction
+	mu sync.Mutex
+}
+
+// newCache creates a cache in dir, creating the directory if needed
+func newCache(base http.RoundTripper, dir string, maxSize int64, offline bool) (*cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &cache{base: base, dir: dir, maxSize: maxSize, offline: offline}, nil
+}
+
+// RoundTrip answers GET requests from the cache where possible
+func (c *cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		if c.offline {
+			return nil, ErrNotCached
+		}
+		return c.base.RoundTrip(req)
+	}
+
+	path := c.path(req)
+	cached, body := c.load(path, req)
+
+	if c.offline {
+		if cached == nil {
+			return nil, ErrNotCached
+		}
+		c.touch(path)
+		return cached, nil
+	}
+
+	if cached != nil && isFresh(cached, path) {
+		c.touch(path)
+		return cached, nil
+	}
+
+	// Ask the server whether the cached copy is still current
+	outgoing := req
+	if cached != nil {
+		outgoing = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			outgoing.Header.Set("If-None-Match", etag)
+		}
+		if modified := cached.Header.Get("Last-Modified"); modified != "" {
+			outgoing.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	resp, err := c.base.RoundTrip(outgoing)
+	if err != nil {
+		// A stale copy beats no copy
+		if cached != nil && req.Context().Err() == nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		for _, name := range []string{"Date", "Cache-Control", "Expires", "ETag", "Last-Modified"} {
+			if value := resp.Header.Get(name); value != "" {
+				cached.Header.Set(name, value)
+			}
+		}
+		c.store(path, cached, body)
+		// Cookies set by this answer still reach the jar, but are not stored
+		for _, cookie := range resp.Header.Values("Set-Cookie") {
+			cached.Header.Add("Set-Cookie", cookie)
+		}
+		return c.response(cached, body), nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusMovedPermanently, http.StatusPermanentRedirect:
+	default:
+		return resp, nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.store(path, resp, data)
+	return c.response(resp, data), nil
+}
+
+// path returns the file of a request in the cache. Requests with cookies are
+// kept apart, so a page read with a session never stands in for the paywalled one.
+func (c *cache) path(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.String() + "\n" + req.Header.Get("Cookie")))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// load reads a cached response and its body, or returns nil if there is none
+func (c *cache) load(path string, req *http.Request) (*http.Response, []byte) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil
+	}
+	// Entries written by older versions may still hold cookies
+	removeUncachedHeaders(resp.Header)
+	return c.response(resp, body), body
+}
+
+// response returns resp with a body reading from data
+func (c *cache) response(resp *http.Response, data []byte) *http.Response {
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.TransferEncoding = nil
+	return resp
+}
+
+// store writes a response to the cache, then evicts old entries if the cache
+// is too big. Failures only cost the cached copy, so they are logged.
+func (c *cache) store(path string, resp *http.Response, body []byte) {
+	header := resp.Header.Clone()
+	removeUncachedHeaders(header)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	// Write to a temporary file first, so readers never see half an entry
+	file, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Warning: Failed to write cache entry: %v", err)
+		return
+	}
+	_, err = file.Write(b.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		log.Printf("Warning: Failed to write cache entry: %v", err)
+		return
+	}
+
+	c.evict()
+}
+
+// hopByHopHeaders only apply to the connection a response came over
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeUncachedHeaders removes the headers a cached response must not
+// replay: cookies, which would overwrite newer ones in the jar, and the
+// hop-by-hop headers, including those the Connection header names
+func removeUncachedHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	header.Del("Set-Cookie")
+	header.Del("Set-Cookie2")
+}
+
+// touch marks a cache entry as recently used
+func (c *cache) touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// evict removes the least recently used entries until the cache fits its size limit
+func (c *cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	if total <= c.maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if os.Remove(filepath.Join(c.dir, file.Name())) == nil {
+			total -= file.Size()
+		}
+	}
+}
+
+// isFresh reports whether a cached response can be used without asking the
+// server, going by its max-age or immutable directive
+func isFresh(resp *http.Response, path string) bool {
+	if hasDirective(resp.Header, "no-cache") || hasDirective(resp.Header, "no-store") {
+		return false
+	}
+	if hasDirective(resp.Header, "immutable") {
+		return true
+	}
+
+	maxAge, ok := directiveValue(resp.Header, "max-age")
+	if !ok {
+		return false
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil {
+		return false
+	}
+
+	// Age is counted from the server's Date, or from when the entry was written
+	stored, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		stored = info.ModTime()
+	}
+	return time.Since(stored) < time.Duration(seconds)*time.Second
+}
+
+// hasDirective reports whether the Cache-Control header contains a directive
+func hasDirective(header http.Header, name string) bool {
+	_, ok := directiveValue(header, name)
+	return ok
+}
+
+// directiveValue returns the value of a Cache-Control directive
+func directiveValue(header http.Header, name string) (string, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
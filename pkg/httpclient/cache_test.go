@@ -0,0 +1,236 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingServer is a test server that counts its requests
+type countingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newCountingServer(t *testing.T, handler http.HandlerFunc) *countingServer {
+	t.Helper()
+	s := &countingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *countingServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// newTestCache creates a cache in a temporary directory in front of the
+// default transport
+func newTestCache(t *testing.T, maxSize int64) *cache {
+	t.Helper()
+	c, err := newCache(http.DefaultTransport, t.TempDir(), maxSize, false)
+	if err != nil {
+		t.Fatalf("newCache failed: %v", err)
+	}
+	return c
+}
+
+// get requests a URL through a RoundTripper and returns the response with
+// its body read
+func get(t *testing.T, rt http.RoundTripper, url string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestCacheServesFreshResponses(t *testing.T) {
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "page")
+	})
+	c := newTestCache(t, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, body := get(t, c, server.URL); body != "page" {
+			t.Errorf("request %d returned %q", i, body)
+		}
+	}
+	if n := server.count(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	tests := []struct {
+		name      string
+		validator string
+		value     string
+		condition string
+	}{
+		{"etag", "ETag", `"v1"`, "If-None-Match"},
+		{"last modified", "Last-Modified", modified, "If-Modified-Since"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conditional int
+			server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.validator, tt.value)
+				if r.Header.Get(tt.condition) == tt.value {
+					conditional++
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprint(w, "page")
+			})
+			c := newTestCache(t, 0)
+
+			get(t, c, server.URL)
+			resp, body := get(t, c, server.URL)
+			if resp.StatusCode != http.StatusOK || body != "page" {
+				t.Errorf("revalidated request returned %d %q", resp.StatusCode, body)
+			}
+			if server.count() != 2 || conditional != 1 {
+				t.Errorf("server got %d requests, %d conditional, want 2 with 1 conditional", server.count(), conditional)
+			}
+		})
+	}
+}
+
+func TestCacheServesStaleOnNetworkError(t *testing.T) {
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "page")
+	})
+	c := newTestCache(t, 0)
+
+	get(t, c, server.URL+"/cached")
+	server.Close()
+
+	if _, body := get(t, c, server.URL+"/cached"); body != "page" {
+		t.Errorf("stale copy returned %q", body)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/other", nil)
+	if _, err := c.RoundTrip(req); err == nil {
+		t.Error("request without a cached copy succeeded")
+	}
+}
+
+func TestCacheOffline(t *testing.T) {
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "page")
+	})
+	c := newTestCache(t, 0)
+	get(t, c, server.URL+"/cached")
+
+	c.offline = true
+	if _, body := get(t, c, server.URL+"/cached"); body != "page" {
+		t.Errorf("offline copy returned %q", body)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/other", nil)
+	if _, err := c.RoundTrip(req); !errors.Is(err, ErrNotCached) {
+		t.Errorf("offline request without a copy returned %v, want ErrNotCached", err)
+	}
+	if n := server.count(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestCacheDoesNotReplayCookies(t *testing.T) {
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "substack.sid=old; Path=/")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("X-Kept", "1")
+		fmt.Fprint(w, "page")
+	})
+	c := newTestCache(t, 0)
+
+	// The first answer comes from the server, so its cookie counts
+	if resp, _ := get(t, c, server.URL); resp.Header.Get("Set-Cookie") == "" {
+		t.Error("the server's cookie did not reach the client")
+	}
+	resp, _ := get(t, c, server.URL)
+	if server.count() != 1 {
+		t.Fatalf("second request was not served from the cache")
+	}
+	for _, name := range []string{"Set-Cookie", "X-Hop", "Connection"} {
+		if value := resp.Header.Get(name); value != "" {
+			t.Errorf("cached response replayed %s: %s", name, value)
+		}
+	}
+	if resp.Header.Get("X-Kept") != "1" {
+		t.Error("cached response lost its other headers")
+	}
+
+	entries, _ := os.ReadDir(c.dir)
+	for _, entry := range entries {
+		data, _ := os.ReadFile(c.dir + "/" + entry.Name())
+		if strings.Contains(string(data), "substack.sid") {
+			t.Errorf("cache entry %s holds the cookie", entry.Name())
+		}
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, strings.Repeat("x", 1000))
+	})
+	c := newTestCache(t, 0)
+
+	paths := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		get(t, c, server.URL+"/"+name)
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/"+name, nil)
+		paths[name] = c.path(req)
+	}
+
+	// a is the oldest entry, but reading it makes b the least recently used
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		old := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(paths[name], old, old)
+	}
+	get(t, c, server.URL+"/a")
+
+	info, err := os.Stat(paths["a"])
+	if err != nil {
+		t.Fatalf("entry a is missing: %v", err)
+	}
+	c.maxSize = 3 * info.Size()
+	get(t, c, server.URL+"/d")
+
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, err := os.Stat(paths[name]); (err == nil) != want {
+			t.Errorf("entry %s kept: %v, want %v", name, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent is sent when no User-Agent is configured. Substack's CDN
+// throttles Go's default User-Agent, so it identifies as a desktop browser.
+const DefaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// Options contains options for the HTTP client
+type Options struct {
+	// Timeout limits each attempt of a request, including reading the body
+	Timeout time.Duration
+	// MaxRetries is the number of times a failed request is retried
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry; it doubles for every retry after
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries. A Retry-After longer than
+	// this is not waited for and the response is returned as is.
+	MaxBackoff time.Duration
+	// RequestsPerSecond limits the request rate to each host (0 for no limit)
+	RequestsPerSecond float64
+	// UserAgent is sent with requests that do not set their own
+	UserAgent string
+	// ProxyURL is the proxy for all requests; empty uses HTTP_PROXY and HTTPS_PROXY
+	ProxyURL string
+	// Jar stores cookies across requests
+	Jar http.CookieJar
+	// CacheDir is where responses are cached; empty disables the cache
+	CacheDir string
+	// CacheMaxSize is the size in bytes the cache is trimmed to (0 for no limit)
+	CacheMaxSize int64
+	// Offline answers requests from the cache only and fails the others
+	// with ErrNotCached
+	Offline bool
+}
+
+// DefaultOptions returns the default HTTP client options, with the cache in
+// the user's cache directory if there is one
+func DefaultOptions() *Options {
+	cacheDir, _ := DefaultCacheDir()
+	return &Options{
+		Timeout:           30 * time.Second,
+		MaxRetries:        3,
+		InitialBackoff:    time.Second,
+		MaxBackoff:        30 * time.Second,
+		RequestsPerSecond: 2,
+		UserAgent:         DefaultUserAgent,
+		CacheDir:          cacheDir,
+		CacheMaxSize:      DefaultCacheSize,
+	}
+}
+
+// New creates an HTTP client that retries failed requests with exponential
+// backoff, limits the request rate per host, sets the User-Agent and caches
+// responses on disk
+func New(options *Options) (*http.Client, error) {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultOptions()
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		base.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var roundTripper http.RoundTripper = &transport{
+		base:    base,
+		options: *options,
+		limiter: newHostLimiter(options.RequestsPerSecond),
+	}
+
+	// The cache goes in front, so cached responses skip the rate limit
+	if options.Offline && options.CacheDir == "" {
+		return nil, fmt.Errorf("offline mode needs a cache directory")
+	}
+	if options.CacheDir != "" {
+		cache, err := newCache(roundTripper, filepath.Join(options.CacheDir, "http"), options.CacheMaxSize, options.Offline)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper = cache
+	}
+
+	return &http.Client{
+		Transport: roundTripper,
+		Jar:       options.Jar,
+	}, nil
+}
+
+// transport is a RoundTripper adding timeouts, retries, rate limiting and a
+// User-Agent to another RoundTripper
+type transport struct {
+	base    http.RoundTripper
+	options Options
+	limiter *hostLimiter
+}
+
+// RoundTrip sends a request, retrying on network errors, 429 and 5xx responses
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" && t.options.UserAgent != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.options.UserAgent)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.attempt(req, attempt)
+		if req.Context().Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+		if attempt >= t.options.MaxRetries || !retryable(resp, err) {
+			return resp, err
+		}
+
+		// Honour Retry-After, unless the server asks for a longer wait than we allow
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				if retryAfter > t.options.MaxBackoff {
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends one try of a request with its own timeout
+func (t *transport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	// Requests with a body need a fresh copy for every retry
+	if attempt > 0 && req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot retry request to %s: body cannot be replayed", req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	if t.options.Timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.options.Timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout also covers reading the body, so it ends when the body is closed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff returns the exponential wait before a retry, with some jitter so
+// parallel requests do not retry in lockstep
+func (t *transport) backoff(attempt int) time.Duration {
+	delay := t.options.InitialBackoff << attempt
+	if delay <= 0 || delay > t.options.MaxBackoff {
+		delay = t.options.MaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryable reports whether a request should be tried again
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// cancelBody releases the timeout of a request once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// hostLimiter spaces out requests to the same host
+type hostLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+// newHostLimiter creates a limiter allowing the given number of requests per
+// second to each host, or no limit for 0
+func newHostLimiter(requestsPerSecond float64) *hostLimiter {
+	limiter := &hostLimiter{next: make(map[string]time.Time)}
+	if requestsPerSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return limiter
+}
+
+// wait blocks until a request to host is allowed or the context is done
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	// Reserve the next slot for this host
+	l.Lock()
+	now := time.Now()
+	slot := l.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[host] = slot.Add(l.interval)
+	l.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,237 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOptions returns options without cache and with short backoffs
+func testOptions() *Options {
+	options := DefaultOptions()
+	options.CacheDir = ""
+	options.RequestsPerSecond = 0
+	options.InitialBackoff = time.Millisecond
+	options.MaxBackoff = 50 * time.Millisecond
+	return options
+}
+
+// failingServer answers with status until it has failed the given number
+// of times, then with 200
+func failingServer(t *testing.T, failures, status int, header http.Header) *countingServer {
+	t.Helper()
+	var mu sync.Mutex
+	return newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		status     int
+		maxRetries int
+		want       int
+		requests   int
+	}{
+		{"recovers", 2, http.StatusServiceUnavailable, 3, http.StatusOK, 3},
+		{"gives up", 5, http.StatusBadGateway, 2, http.StatusBadGateway, 3},
+		{"no retries", 1, http.StatusTooManyRequests, 0, http.StatusTooManyRequests, 1},
+		{"client errors are final", 1, http.StatusNotFound, 3, http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := failingServer(t, tt.failures, tt.status, nil)
+			options := testOptions()
+			options.MaxRetries = tt.maxRetries
+			client, err := New(options)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if n := server.count(); n != tt.requests {
+				t.Errorf("server got %d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestClientRetriesNetworkErrors(t *testing.T) {
+	server := failingServer(t, 0, 0, nil)
+	server.Close()
+
+	options := testOptions()
+	options.MaxRetries = 2
+	client, err := New(options)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("request to a closed server succeeded")
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	options := testOptions()
+	options.MaxRetries = 3
+	client, err := New(options)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// A short Retry-After is waited for
+	server := failingServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || server.count() != 2 {
+		t.Errorf("got status %d after %d requests, want 200 after 2", resp.StatusCode, server.count())
+	}
+
+	// A Retry-After longer than MaxBackoff returns the response at once
+	server = failingServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}})
+	start := time.Now()
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || server.count() != 1 {
+		t.Errorf("got status %d after %d requests, want 503 after 1", resp.StatusCode, server.count())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request waited %v for a Retry-After over the limit", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got, ok := parseRetryAfter(future); !ok || got <= 0 || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, %v, want up to a minute", future, got, ok)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	limiter := newHostLimiter(20)
+	ctx := context.Background()
+
+	// Requests to one host are spaced out, other hosts have their own slots
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limiter.wait(ctx, "a.example"); err != nil {
+			t.Fatalf("wait failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("4 requests at 20 per second took %v, want at least 150ms", elapsed)
+	}
+
+	start = time.Now()
+	if err := limiter.wait(ctx, "b.example"); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("first request to another host waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limiter.wait(ctx, "a.example"); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait with a cancelled context returned %v", err)
+	}
+
+	// No limit never waits
+	unlimited := newHostLimiter(0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		unlimited.wait(context.Background(), "a.example")
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("unlimited requests waited %v", elapsed)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server := failingServer(t, 0, 0, nil)
+	options := testOptions()
+	options.RequestsPerSecond = 20
+	client, err := New(options)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 requests at 20 per second took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestClientUserAgent(t *testing.T) {
+	var got []string
+	server := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.UserAgent())
+	})
+	client, err := New(testOptions())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	client.Get(server.URL)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("User-Agent", "custom")
+	client.Do(req)
+	if len(got) != 2 || got[0] != DefaultUserAgent || got[1] != "custom" {
+		t.Errorf("server saw User-Agents %q", got)
+	}
+}
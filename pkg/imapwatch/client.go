@@ -0,0 +1,289 @@
+package imapwatch
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// commandTimeout is how long the server may take to answer a command
+	commandTimeout = 2 * time.Minute
+	// maxLiteralSize is the largest literal read, which bounds the size of
+	// a message
+	maxLiteralSize = 100 << 20
+)
+
+var (
+	// literalSuffix matches the size of a literal that follows a response line
+	literalSuffix = regexp.MustCompile(`\{(\d+)\}$`)
+	// uidValidity matches the UIDVALIDITY response code of SELECT
+	uidValidity = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+	// fetchUID matches the UID item of a FETCH response
+	fetchUID = regexp.MustCompile(`\bUID (\d+)`)
+)
+
+// response is a server response line with the literals it carries
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+// client speaks just enough IMAP4rev1 (RFC 3501) to find, read and file
+// messages in one folder
+type client struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	tag          int
+	capabilities map[string]bool
+	// stop unregisters closing the connection on cancellation
+	stop func() bool
+}
+
+// dial connects to the server of the config and reads its greeting. The
+// connection is closed when the context is cancelled.
+func dial(ctx context.Context, config *Config) (*client, error) {
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		host, _, err := net.SplitHostPort(config.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IMAP address: %w", err)
+		}
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if config.Security == SecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", config.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", config.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IMAP server: %w", err)
+	}
+	c := &client{conn: conn, reader: bufio.NewReader(conn)}
+	c.stop = context.AfterFunc(ctx, func() { c.conn.Close() })
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		c.stop()
+		conn.Close()
+		return nil, fmt.Errorf("failed to read IMAP greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		c.stop()
+		conn.Close()
+		return nil, fmt.Errorf("IMAP server refused connection: %s", greeting.line)
+	}
+
+	if config.Security == SecurityStartTLS {
+		if _, err := c.command("STARTTLS"); err != nil {
+			c.stop()
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			c.stop()
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(tlsConn)
+	}
+
+	return c, nil
+}
+
+// close logs out and closes the connection. Cancellation still closes the
+// connection while logging out.
+func (c *client) close() {
+	c.command("LOGOUT")
+	c.stop()
+	c.conn.Close()
+}
+
+// login authenticates and reads the capabilities of the server
+func (c *client) login(username, password string) error {
+	if _, err := c.command("LOGIN %s %s", quote(username), quote(password)); err != nil {
+		return err
+	}
+
+	responses, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	c.capabilities = make(map[string]bool)
+	for _, resp := range responses {
+		if fields := strings.Fields(resp.line); len(fields) > 1 && fields[1] == "CAPABILITY" {
+			for _, capability := range fields[2:] {
+				c.capabilities[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// selectFolder opens a folder and returns its UIDVALIDITY
+func (c *client) selectFolder(folder string) (uint32, error) {
+	responses, err := c.command("SELECT %s", quote(folder))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if match := uidValidity.FindStringSubmatch(resp.line); match != nil {
+			validity, err := strconv.ParseUint(match[1], 10, 32)
+			if err == nil {
+				return uint32(validity), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("IMAP server did not report UIDVALIDITY of %s", folder)
+}
+
+// unseenSince returns the UIDs of unread messages newer than a UID, in order
+func (c *client) unseenSince(lastUID uint32) ([]uint32, error) {
+	responses, err := c.command("UID SEARCH UNSEEN UID %d:*", lastUID+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, resp := range responses {
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || fields[1] != "SEARCH" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			// n:* always includes the last message, even when its UID is lower
+			if err == nil && uint32(uid) > lastUID {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetch returns a section of a message without marking it as read, e.g.
+// "HEADER.FIELDS (FROM)" or "" for the whole message
+func (c *client) fetch(uid uint32, section string) ([]byte, error) {
+	responses, err := c.command("UID FETCH %d (UID BODY.PEEK[%s])", uid, section)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		match := fetchUID.FindStringSubmatch(resp.line)
+		if match == nil || match[1] != strconv.FormatUint(uint64(uid), 10) || len(resp.literals) == 0 {
+			continue
+		}
+		return resp.literals[0], nil
+	}
+	return nil, fmt.Errorf("IMAP server returned no data for message %d", uid)
+}
+
+// markSeen marks a message as read
+func (c *client) markSeen(uid uint32) error {
+	_, err := c.command(`UID STORE %d +FLAGS.SILENT (\Seen)`, uid)
+	return err
+}
+
+// move moves a message to another folder, copying and deleting it on
+// servers without the MOVE extension
+func (c *client) move(uid uint32, folder string) error {
+	if c.capabilities["MOVE"] {
+		_, err := c.command("UID MOVE %d %s", uid, quote(folder))
+		return err
+	}
+
+	if _, err := c.command("UID COPY %d %s", uid, quote(folder)); err != nil {
+		return err
+	}
+	if _, err := c.command(`UID STORE %d +FLAGS.SILENT (\Deleted)`, uid); err != nil {
+		return err
+	}
+	// Without UIDPLUS, expunging could remove other deleted messages, so the
+	// server is left to do it
+	if c.capabilities["UIDPLUS"] {
+		_, err := c.command("UID EXPUNGE %d", uid)
+		return err
+	}
+	return nil
+}
+
+// command sends a command and returns its untagged responses, or an error
+// if the server does not answer OK within commandTimeout
+func (c *client) command(format string, args ...interface{}) ([]*response, error) {
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	command := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, fmt.Errorf("failed to send IMAP command: %w", err)
+	}
+
+	// Don't echo passwords in errors
+	name := strings.Fields(command)[0]
+	if name == "UID" {
+		name = strings.Join(strings.Fields(command)[:2], " ")
+	}
+
+	var untagged []*response
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IMAP response: %w", err)
+		}
+		if status, ok := strings.CutPrefix(resp.line, tag+" "); ok {
+			if strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return untagged, nil
+			}
+			return nil, fmt.Errorf("IMAP %s failed: %s", name, status)
+		}
+		untagged = append(untagged, resp)
+	}
+}
+
+// readResponse reads a response line, including any literals in it
+func (c *client) readResponse() (*response, error) {
+	resp := &response{}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+
+		match := literalSuffix.FindStringSubmatch(line)
+		if match == nil {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid literal size: %w", err)
+		}
+		if size > maxLiteralSize {
+			return nil, fmt.Errorf("literal of %d bytes is larger than the limit of %d bytes", size, maxLiteralSize)
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, literal); err != nil {
+			return nil, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// quote returns a string as an IMAP quoted string
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
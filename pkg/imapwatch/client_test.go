@@ -0,0 +1,92 @@
+package imapwatch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialScripted connects a client to a server that greets it and then answers
+// every command line with reply
+func dialScripted(t *testing.T, ctx context.Context, reply func(tag string) string) *client {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "* OK ready\r\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, _, _ := strings.Cut(line, " ")
+			fmt.Fprint(conn, reply(tag))
+		}
+	}()
+
+	c, err := dial(ctx, &Config{Addr: listener.Addr().String(), Security: SecurityNone})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	return c
+}
+
+func TestReadResponseLimitsLiterals(t *testing.T) {
+	c := dialScripted(t, context.Background(), func(tag string) string {
+		return fmt.Sprintf("* 1 FETCH (UID 1 BODY[] {%d}\r\n", maxLiteralSize+1)
+	})
+	defer c.conn.Close()
+
+	_, err := c.fetch(1, "")
+	if err == nil || !strings.Contains(err.Error(), "larger than the limit") {
+		t.Fatalf("fetch returned %v, want an error about the literal size", err)
+	}
+}
+
+func TestReadResponseReadsLiterals(t *testing.T) {
+	c := dialScripted(t, context.Background(), func(tag string) string {
+		return "* 1 FETCH (UID 7 BODY[] {7}\r\nSubject)\r\n" + tag + " OK done\r\n"
+	})
+	defer c.conn.Close()
+
+	data, err := c.fetch(7, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if string(data) != "Subject" {
+		t.Errorf("fetch returned %q, want the literal", data)
+	}
+}
+
+func TestCloseIsCancelledDuringLogout(t *testing.T) {
+	// The server never answers, so only cancellation ends the LOGOUT
+	ctx, cancel := context.WithCancel(context.Background())
+	c := dialScripted(t, ctx, func(tag string) string { return "" })
+
+	closed := make(chan struct{})
+	go func() {
+		c.close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not return after cancellation")
+	}
+}
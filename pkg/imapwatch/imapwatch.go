@@ -0,0 +1,308 @@
+// Package imapwatch watches an IMAP folder for newsletters and hands every
+// new message from an allowed sender to a handler, e.g. one that converts
+// it and sends it to Kindle
+package imapwatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"substack-to-kindle/pkg/allowlist"
+)
+
+// Security is how the connection to the IMAP server is protected
+type Security string
+
+const (
+	// SecurityTLS connects with TLS from the start, usually on port 993
+	SecurityTLS Security = "tls"
+	// SecurityStartTLS upgrades a plain connection with STARTTLS, usually on port 143
+	SecurityStartTLS Security = "starttls"
+	// SecurityNone sends everything, including the password, in the clear. It
+	// is only meant for local test servers.
+	SecurityNone Security = "none"
+)
+
+// Config contains the IMAP account and folders to watch
+type Config struct {
+	// Addr is the host and port of the server, e.g. "imap.gmail.com:993"
+	Addr     string
+	Username string
+	Password string
+	Security Security
+	// TLSConfig overrides the TLS settings, e.g. to trust a test certificate
+	TLSConfig *tls.Config
+	// Folder is the folder newsletters arrive in
+	Folder string
+	// ArchiveFolder is where processed messages are moved; if empty they
+	// are only marked as read
+	ArchiveFolder string
+	// AllowedSenders are the addresses or domains whose messages are processed
+	AllowedSenders allowlist.List
+	// StatePath is the file that records the messages already processed
+	StatePath string
+	// Interval is the time between polls
+	Interval time.Duration
+}
+
+// LoadConfigFromEnv loads the IMAP configuration from environment
+// variables. The account defaults to the one used for sending.
+func LoadConfigFromEnv() Config {
+	config := Config{
+		Addr:           net.JoinHostPort(os.Getenv("IMAP_HOST"), envOr("IMAP_PORT", "993")),
+		Username:       envOr("IMAP_USERNAME", os.Getenv("EMAIL_FROM")),
+		Password:       envOr("IMAP_PASSWORD", os.Getenv("EMAIL_PASSWORD")),
+		Security:       Security(strings.ToLower(envOr("IMAP_SECURITY", string(SecurityTLS)))),
+		Folder:         envOr("IMAP_FOLDER", "Newsletters"),
+		ArchiveFolder:  os.Getenv("IMAP_ARCHIVE_FOLDER"),
+		AllowedSenders: allowlist.Parse(os.Getenv("IMAP_ALLOWED_SENDERS")),
+		Interval:       5 * time.Minute,
+	}
+	if path, err := DefaultStatePath(); err == nil {
+		config.StatePath = path
+	}
+	return config
+}
+
+// envOr returns an environment variable, or fallback if it is not set
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// DefaultStatePath returns the state file inside the user's config
+// directory, e.g. ~/.config/substack-to-kindle/imap-state.json on Linux
+func DefaultStatePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find user config directory: %w", err)
+	}
+	return filepath.Join(dir, "substack-to-kindle", "imap-state.json"), nil
+}
+
+// validate checks that the config names a server, an account and senders
+func (c *Config) validate() error {
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil || host == "" {
+		return fmt.Errorf("no IMAP server configured, set IMAP_HOST")
+	}
+	if c.Username == "" || c.Password == "" {
+		return fmt.Errorf("no IMAP account configured, set IMAP_USERNAME and IMAP_PASSWORD")
+	}
+	switch c.Security {
+	case SecurityTLS, SecurityStartTLS, SecurityNone:
+	default:
+		return fmt.Errorf("unsupported IMAP security: %q (use tls, starttls or none)", c.Security)
+	}
+	if c.Folder == "" {
+		return fmt.Errorf("no IMAP folder configured")
+	}
+	if len(c.AllowedSenders) == 0 {
+		return fmt.Errorf("no allowed senders configured, set IMAP_ALLOWED_SENDERS")
+	}
+	if c.StatePath == "" {
+		return fmt.Errorf("no state file configured")
+	}
+	return nil
+}
+
+// maxAttempts is how often a message the handler fails on is tried before
+// it is given up
+const maxAttempts = 3
+
+// Handler processes the raw RFC 5322 message of a newsletter. Messages for
+// which it returns an error are left unread and tried again at the next
+// polls, up to maxAttempts times.
+type Handler func(ctx context.Context, message []byte) error
+
+// Watcher polls an IMAP folder and hands new messages to a handler
+type Watcher struct {
+	config  Config
+	handler Handler
+}
+
+// New creates a watcher for the folder of the config
+func New(config Config, handler Handler) (*Watcher, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Watcher{config: config, handler: handler}, nil
+}
+
+// Run polls the folder until the context is cancelled. Failed polls are
+// logged and retried at the next interval.
+func (w *Watcher) Run(ctx context.Context) error {
+	interval := w.config.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Failed to check %s: %v", w.config.Folder, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll processes the unread messages that arrived since the last poll, and
+// those that failed before, and returns how many were handled. Every message
+// is recorded in the state file once it has been looked at, so it is never
+// handed to the handler again after it succeeded, and at most maxAttempts
+// times if it keeps failing.
+func (w *Watcher) Poll(ctx context.Context) (int, error) {
+	state, err := loadState(w.config.StatePath)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := dial(ctx, &w.config)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+
+	if err := c.login(w.config.Username, w.config.Password); err != nil {
+		return 0, err
+	}
+	validity, err := c.selectFolder(w.config.Folder)
+	if err != nil {
+		return 0, err
+	}
+
+	// UIDs only identify messages as long as UIDVALIDITY stays the same
+	key := w.stateKey()
+	folder := state.Folders[key]
+	if folder.UIDValidity != validity {
+		folder = folderState{UIDValidity: validity}
+	}
+	retries := folder.Retries
+	folder.Retries = make(map[uint32]int)
+
+	// Search from the oldest message up for a retry, then keep the new ones
+	// and the retries that are still unread
+	since := folder.LastUID
+	for uid := range retries {
+		if uid <= since {
+			since = uid - 1
+		}
+	}
+	unseen, err := c.unseenSince(since)
+	if err != nil {
+		return 0, err
+	}
+	var uids []uint32
+	for _, uid := range unseen {
+		if attempts, ok := retries[uid]; ok {
+			folder.Retries[uid] = attempts
+			uids = append(uids, uid)
+		} else if uid > folder.LastUID {
+			uids = append(uids, uid)
+		}
+	}
+
+	handled := 0
+	for _, uid := range uids {
+		ok, err := w.process(ctx, c, uid)
+		if ok {
+			handled++
+		}
+		delete(folder.Retries, uid)
+		if err != nil {
+			if ctx.Err() != nil {
+				return handled, ctx.Err()
+			}
+			attempts := retries[uid] + 1
+			switch {
+			case ok:
+				// The message was sent, so it must not be sent again
+				log.Printf("Warning: Failed to file away message %d: %v", uid, err)
+			case attempts < maxAttempts:
+				log.Printf("Warning: Failed to process message %d, will retry: %v", uid, err)
+				folder.Retries[uid] = attempts
+			default:
+				log.Printf("Warning: Failed to process message %d, giving up after %d attempts: %v", uid, attempts, err)
+			}
+		}
+
+		if uid > folder.LastUID {
+			folder.LastUID = uid
+		}
+		state.Folders[key] = folder
+		if err := state.save(w.config.StatePath); err != nil {
+			return handled, err
+		}
+	}
+
+	// Retries that were read or removed in the meantime are dropped
+	if len(folder.Retries) != len(retries) {
+		state.Folders[key] = folder
+		if err := state.save(w.config.StatePath); err != nil {
+			return handled, err
+		}
+	}
+
+	return handled, nil
+}
+
+// process hands one message to the handler if its sender is allowed, then
+// marks it as read and files it away. It reports whether the message was
+// handed to the handler.
+func (w *Watcher) process(ctx context.Context, c *client, uid uint32) (bool, error) {
+	header, err := c.fetch(uid, "HEADER.FIELDS (FROM)")
+	if err != nil {
+		return false, err
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(append(header, '\r', '\n')))
+	if err != nil {
+		return false, fmt.Errorf("failed to read headers: %w", err)
+	}
+	from, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read sender: %w", err)
+	}
+	if !w.config.AllowedSenders.Allows(from.Address) {
+		// Leave other mail in the folder alone
+		log.Printf("Skipping message %d from %s, who is not an allowed sender", uid, from.Address)
+		return false, nil
+	}
+
+	data, err := c.fetch(uid, "")
+	if err != nil {
+		return false, err
+	}
+	if err := w.handler(ctx, data); err != nil {
+		return false, err
+	}
+
+	if err := c.markSeen(uid); err != nil {
+		return true, err
+	}
+	if w.config.ArchiveFolder != "" {
+		return true, c.move(uid, w.config.ArchiveFolder)
+	}
+	return true, nil
+}
+
+// stateKey identifies the watched folder of the account in the state file
+func (w *Watcher) stateKey() string {
+	return fmt.Sprintf("%s@%s/%s", w.config.Username, w.config.Addr, w.config.Folder)
+}
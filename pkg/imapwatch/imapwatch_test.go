@@ -0,0 +1,514 @@
+package imapwatch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"substack-to-kindle/pkg/allowlist"
+)
+
+// fakeMessage is a message in the mailbox of a fakeServer
+type fakeMessage struct {
+	uid     uint32
+	from    string
+	body    string
+	seen    bool
+	deleted bool
+}
+
+// fakeServer is an IMAP server with one folder, just good enough for the watcher
+type fakeServer struct {
+	mu           sync.Mutex
+	listener     net.Listener
+	capabilities []string
+	uidValidity  uint32
+	nextUID      uint32
+	messages     []*fakeMessage
+	// archived are the bodies of the messages moved or copied to another folder
+	archived map[string][]string
+	// commands are the commands received, without tags and arguments
+	commands []string
+}
+
+// newFakeServer starts a fake server that listens until the test ends
+func newFakeServer(t *testing.T, capabilities ...string) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &fakeServer{
+		listener:     listener,
+		capabilities: capabilities,
+		uidValidity:  1,
+		nextUID:      1,
+		archived:     make(map[string][]string),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// deliver adds an unread message and returns its UID
+func (s *fakeServer) deliver(from, body string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid := s.nextUID
+	s.nextUID++
+	s.messages = append(s.messages, &fakeMessage{uid: uid, from: from, body: body})
+	return uid
+}
+
+// message returns the message with a UID, or nil if it is gone
+func (s *fakeServer) message(uid uint32) *fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.uid == uid {
+			return m
+		}
+	}
+	return nil
+}
+
+// count returns how often a command was received
+func (s *fakeServer) count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.commands {
+		if c == command {
+			n++
+		}
+	}
+	return n
+}
+
+// quotedArgument matches the quoted folder name at the end of a command
+var quotedArgument = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"$`)
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK fake IMAP ready\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(command)
+		name := strings.ToUpper(fields[0])
+		if name == "UID" {
+			name += " " + strings.ToUpper(fields[1])
+			fields = fields[1:]
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, name)
+		reply := s.handle(conn, name, fields, command)
+		s.mu.Unlock()
+
+		fmt.Fprintf(conn, "%s %s\r\n", tag, reply)
+		if name == "LOGOUT" {
+			return
+		}
+	}
+}
+
+// handle answers a command with untagged responses and returns the status of
+// the tagged response
+func (s *fakeServer) handle(conn net.Conn, name string, fields []string, command string) string {
+	switch name {
+	case "LOGIN", "NOOP":
+	case "CAPABILITY":
+		fmt.Fprintf(conn, "* CAPABILITY IMAP4rev1 %s\r\n", strings.Join(s.capabilities, " "))
+	case "SELECT":
+		fmt.Fprintf(conn, "* %d EXISTS\r\n", len(s.messages))
+		fmt.Fprintf(conn, "* OK [UIDVALIDITY %d] UIDs valid\r\n", s.uidValidity)
+	case "UID SEARCH":
+		// UID SEARCH UNSEEN UID n:*
+		from, _ := strconv.ParseUint(strings.TrimSuffix(fields[3], ":*"), 10, 32)
+		var uids []string
+		var last uint32
+		for _, m := range s.messages {
+			if m.deleted {
+				continue
+			}
+			last = m.uid
+			if !m.seen && m.uid >= uint32(from) {
+				uids = append(uids, strconv.FormatUint(uint64(m.uid), 10))
+			}
+		}
+		// Like real servers, n:* includes the last message even below n
+		if len(uids) == 0 && last != 0 && last < uint32(from) {
+			if m := s.find(last); !m.seen {
+				uids = append(uids, strconv.FormatUint(uint64(last), 10))
+			}
+		}
+		fmt.Fprintf(conn, "* SEARCH %s\r\n", strings.Join(uids, " "))
+	case "UID FETCH":
+		m := s.find(parseUID(fields[1]))
+		if m == nil {
+			break
+		}
+		data := "From: " + m.from + "\r\nSubject: Test\r\n\r\n" + m.body
+		section := "BODY[]"
+		if strings.Contains(command, "HEADER.FIELDS") {
+			data = "From: " + m.from + "\r\n"
+			section = "BODY[HEADER.FIELDS (FROM)]"
+		}
+		fmt.Fprintf(conn, "* 1 FETCH (UID %d %s {%d}\r\n%s)\r\n", m.uid, section, len(data), data)
+	case "UID STORE":
+		if m := s.find(parseUID(fields[1])); m != nil {
+			m.seen = m.seen || strings.Contains(command, `\Seen`)
+			m.deleted = m.deleted || strings.Contains(command, `\Deleted`)
+		}
+	case "UID COPY", "UID MOVE":
+		m := s.find(parseUID(fields[1]))
+		if m == nil {
+			return "NO no such message"
+		}
+		folder := quotedArgument.FindStringSubmatch(command)[1]
+		s.archived[folder] = append(s.archived[folder], m.body)
+		if name == "UID MOVE" {
+			s.remove(m.uid)
+		}
+	case "UID EXPUNGE":
+		if m := s.find(parseUID(fields[1])); m != nil && m.deleted {
+			s.remove(m.uid)
+		}
+	case "LOGOUT":
+		fmt.Fprint(conn, "* BYE\r\n")
+	default:
+		return "BAD unknown command"
+	}
+	return "OK done"
+}
+
+// find returns a message by UID; the lock must be held
+func (s *fakeServer) find(uid uint32) *fakeMessage {
+	for _, m := range s.messages {
+		if m.uid == uid {
+			return m
+		}
+	}
+	return nil
+}
+
+// remove expunges a message; the lock must be held
+func (s *fakeServer) remove(uid uint32) {
+	for i, m := range s.messages {
+		if m.uid == uid {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func parseUID(field string) uint32 {
+	uid, _ := strconv.ParseUint(field, 10, 32)
+	return uint32(uid)
+}
+
+// recorder is a handler that keeps the messages it was given and fails for
+// bodies in fail
+type recorder struct {
+	mu       sync.Mutex
+	messages []string
+	fail     map[string]bool
+}
+
+func (r *recorder) handle(ctx context.Context, message []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, body, _ := strings.Cut(string(message), "\r\n\r\n")
+	r.messages = append(r.messages, body)
+	if r.fail[body] {
+		return fmt.Errorf("conversion failed")
+	}
+	return nil
+}
+
+// newTestWatcher creates a watcher for a fake server with its state in a
+// temporary directory
+func newTestWatcher(t *testing.T, server *fakeServer, statePath string, handler Handler) *Watcher {
+	t.Helper()
+	if statePath == "" {
+		statePath = filepath.Join(t.TempDir(), "state.json")
+	}
+	w, err := New(Config{
+		Addr:           server.listener.Addr().String(),
+		Username:       "reader@example.com",
+		Password:       "secret",
+		Security:       SecurityNone,
+		Folder:         "Newsletters",
+		AllowedSenders: allowlist.Parse("substack.com, news@example.org"),
+		StatePath:      statePath,
+	}, handler)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return w
+}
+
+// poll polls once and checks the number of handled messages
+func poll(t *testing.T, w *Watcher, want int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	handled, err := w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if handled != want {
+		t.Fatalf("Poll handled %d messages, want %d", handled, want)
+	}
+}
+
+func TestPollHandlesAllowedSendersOnce(t *testing.T) {
+	server := newFakeServer(t)
+	allowed := server.deliver("Jane Doe <jane@mail.substack.com>", "first post")
+	other := server.deliver("Bank <alerts@bank.example>", "statement")
+	direct := server.deliver("News <news@example.org>", "second post")
+
+	r := &recorder{}
+	w := newTestWatcher(t, server, "", r.handle)
+	poll(t, w, 2)
+
+	if got := strings.Join(r.messages, ", "); got != "first post, second post" {
+		t.Errorf("handler got %q, want the two allowed messages", got)
+	}
+	if !server.message(allowed).seen || !server.message(direct).seen {
+		t.Errorf("handled messages were not marked as read")
+	}
+	if server.message(other).seen {
+		t.Errorf("message from a sender who is not allowed was marked as read")
+	}
+
+	// Nothing new arrived, so the next poll leaves everything alone
+	fetches := server.count("UID FETCH")
+	poll(t, w, 0)
+	if len(r.messages) != 2 {
+		t.Errorf("handler was called %d times, want 2", len(r.messages))
+	}
+	if got := server.count("UID FETCH"); got != fetches {
+		t.Errorf("second poll fetched %d messages, want none", got-fetches)
+	}
+
+	// Only a new message is processed
+	server.deliver("News <news@example.org>", "third post")
+	poll(t, w, 1)
+	if last := r.messages[len(r.messages)-1]; len(r.messages) != 3 || last != "third post" {
+		t.Errorf("handler got %q, want the new message only", r.messages)
+	}
+}
+
+func TestPollArchivesMessages(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		commands     []string
+		expunged     bool
+	}{
+		{"move", []string{"MOVE", "UIDPLUS"}, []string{"UID MOVE"}, true},
+		{"copy and expunge", []string{"UIDPLUS"}, []string{"UID COPY", "UID EXPUNGE"}, true},
+		{"copy only", nil, []string{"UID COPY"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, tt.capabilities...)
+			uid := server.deliver("news@example.org", "post")
+
+			r := &recorder{}
+			w := newTestWatcher(t, server, "", r.handle)
+			w.config.ArchiveFolder = "Newsletters/Sent"
+			poll(t, w, 1)
+
+			for _, command := range tt.commands {
+				if server.count(command) != 1 {
+					t.Errorf("%s was sent %d times, want once", command, server.count(command))
+				}
+			}
+			for _, command := range []string{"UID MOVE", "UID COPY", "UID EXPUNGE"} {
+				if server.count(command) > 0 && !contains(tt.commands, command) {
+					t.Errorf("unexpected %s", command)
+				}
+			}
+			if got := server.archived["Newsletters/Sent"]; len(got) != 1 || got[0] != "post" {
+				t.Errorf("archive folder has %q, want the message", got)
+			}
+
+			m := server.message(uid)
+			if tt.expunged && m != nil {
+				t.Errorf("message is still in the folder")
+			}
+			if !tt.expunged && (m == nil || !m.deleted) {
+				t.Errorf("message was not flagged as deleted")
+			}
+		})
+	}
+}
+
+func TestPollUIDValidityReset(t *testing.T) {
+	server := newFakeServer(t)
+	server.deliver("news@example.org", "old post")
+	server.deliver("news@example.org", "older post")
+
+	r := &recorder{}
+	w := newTestWatcher(t, server, "", r.handle)
+	poll(t, w, 2)
+
+	// The server renumbers the folder, so UID 1 is a different message now
+	server.mu.Lock()
+	server.uidValidity = 2
+	server.messages = nil
+	server.nextUID = 1
+	server.mu.Unlock()
+	server.deliver("news@example.org", "new post")
+
+	poll(t, w, 1)
+	if last := r.messages[len(r.messages)-1]; last != "new post" {
+		t.Errorf("handler got %q, want the new post", last)
+	}
+
+	state, err := loadState(w.config.StatePath)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	folder := state.Folders[w.stateKey()]
+	if folder.UIDValidity != 2 || folder.LastUID != 1 {
+		t.Errorf("state is %+v, want UIDVALIDITY 2 and last UID 1", folder)
+	}
+}
+
+func TestPollStatePersists(t *testing.T) {
+	server := newFakeServer(t)
+	handled := server.deliver("news@example.org", "post")
+	server.deliver("someone@else.example", "private")
+
+	statePath := filepath.Join(t.TempDir(), "nested", "state.json")
+	r := &recorder{}
+	poll(t, newTestWatcher(t, server, statePath, r.handle), 1)
+
+	state, err := loadState(statePath)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	folder := state.Folders["reader@example.com@"+server.listener.Addr().String()+"/Newsletters"]
+	if folder.UIDValidity != 1 || folder.LastUID != 2 {
+		t.Errorf("state is %+v, want UIDVALIDITY 1 and last UID 2", folder)
+	}
+
+	// A new watcher, e.g. after a restart, picks up where the last one left
+	// off, even if the user marked the message as unread again
+	server.mu.Lock()
+	server.find(handled).seen = false
+	server.mu.Unlock()
+	fetches := server.count("UID FETCH")
+	poll(t, newTestWatcher(t, server, statePath, r.handle), 0)
+	if len(r.messages) != 1 {
+		t.Errorf("handler was called %d times, want once", len(r.messages))
+	}
+	if got := server.count("UID FETCH"); got != fetches {
+		t.Errorf("restarted watcher fetched %d messages, want none", got-fetches)
+	}
+}
+
+func TestPollRetriesFailedMessages(t *testing.T) {
+	server := newFakeServer(t)
+	failing := server.deliver("news@example.org", "broken")
+	flaky := server.deliver("news@example.org", "flaky")
+	server.deliver("news@example.org", "fine")
+
+	r := &recorder{fail: map[string]bool{"broken": true, "flaky": true}}
+	w := newTestWatcher(t, server, "", r.handle)
+	poll(t, w, 1)
+	if server.message(failing).seen || server.message(flaky).seen {
+		t.Errorf("failed messages were marked as read")
+	}
+
+	// Both failed messages are tried again, and the one that works now is done
+	r.fail["flaky"] = false
+	poll(t, w, 1)
+	if !server.message(flaky).seen {
+		t.Errorf("message that succeeded on retry was not marked as read")
+	}
+
+	state, err := loadState(w.config.StatePath)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	folder := state.Folders[w.stateKey()]
+	if folder.LastUID != 3 || len(folder.Retries) != 1 || folder.Retries[failing] != 2 {
+		t.Errorf("state is %+v, want last UID 3 and two attempts of message %d", folder, failing)
+	}
+
+	// The third attempt is the last
+	poll(t, w, 0)
+	poll(t, w, 0)
+	attempts := 0
+	for _, message := range r.messages {
+		if message == "broken" {
+			attempts++
+		}
+	}
+	if attempts != maxAttempts {
+		t.Errorf("failing message was tried %d times, want %d", attempts, maxAttempts)
+	}
+	if server.message(failing).seen {
+		t.Errorf("message that was given up on was marked as read")
+	}
+}
+
+func TestPollDropsRetriesReadElsewhere(t *testing.T) {
+	server := newFakeServer(t)
+	uid := server.deliver("news@example.org", "broken")
+
+	r := &recorder{fail: map[string]bool{"broken": true}}
+	w := newTestWatcher(t, server, "", r.handle)
+	poll(t, w, 0)
+
+	// The user reads the message in their mail client
+	server.mu.Lock()
+	server.find(uid).seen = true
+	server.mu.Unlock()
+	poll(t, w, 0)
+
+	if len(r.messages) != 1 {
+		t.Errorf("handler was called %d times, want once", len(r.messages))
+	}
+	state, err := loadState(w.config.StatePath)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if retries := state.Folders[w.stateKey()].Retries; len(retries) != 0 {
+		t.Errorf("retries are %v, want none", retries)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package imapwatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// folderState records how far a folder has been processed
+type folderState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	// LastUID is the highest UID looked at; messages up to it are only
+	// processed again if they are up for a retry
+	LastUID uint32 `json:"last_uid"`
+	// Retries counts the failed attempts of messages up to LastUID that are
+	// tried again at the next poll
+	Retries map[uint32]int `json:"retries,omitempty"`
+}
+
+// state is the contents of the state file, by account and folder
+type state struct {
+	Folders map[string]folderState `json:"folders"`
+}
+
+// loadState reads the state file, starting afresh if there is none yet
+func loadState(path string) (*state, error) {
+	s := &state{Folders: make(map[string]folderState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IMAP state: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse IMAP state %s: %w", path, err)
+	}
+	if s.Folders == nil {
+		s.Folders = make(map[string]folderState)
+	}
+	return s, nil
+}
+
+// save writes the state file through a temporary file, so a crash never
+// leaves it half written
+func (s *state) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode IMAP state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".imap-state-*")
+	if err != nil {
+		return fmt.Errorf("failed to write IMAP state: %w", err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write IMAP state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ErrNoPostSlug is returned for URLs that do not point at a /p/{slug} post
+var ErrNoPostSlug = errors.New("URL does not contain a post slug")
+
+// apiPost mirrors the parts of Substack's /api/v1/posts/{slug} response we use
+type apiPost struct {
+	ID            int64        `json:"id"`
+	Title         string       `json:"title"`
+	Subtitle      string       `json:"subtitle"`
+	Slug          string       `json:"slug"`
+	CanonicalURL  string       `json:"canonical_url"`
+	BodyHTML      string       `json:"body_html"`
+	PostDate      flexibleTime `json:"post_date"`
+	Audience      string       `json:"audience"`
+	CoverImage    string       `json:"cover_image"`
+	SectionName   string       `json:"section_name"`
+	Description   string       `json:"description"`
+	UpdatedAt     flexibleTime `json:"updated_at"`
+	PublicationID int64        `json:"publication_id"`
+	PostTags      []struct {
+		Name string `json:"name"`
+	} `json:"postTags"`
+	PublishedBylines []struct {
+		Name             string `json:"name"`
+		PublicationUsers []struct {
+			Publication apiPublication `json:"publication"`
+		} `json:"publicationUsers"`
+	} `json:"publishedBylines"`
+	TruncatedBodyText string `json:"truncated_body_text"`
+}
+
+// apiPublication is the publication embedded in a byline
+type apiPublication struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Language string `json:"language"`
+}
+
+// publication returns the publication the post belongs to, as far as the
+// bylines tell
+func (p *apiPost) publication() apiPublication {
+	for _, byline := range p.PublishedBylines {
+		for _, user := range byline.PublicationUsers {
+			if user.Publication.ID == p.PublicationID {
+				return user.Publication
+			}
+		}
+	}
+	return apiPublication{}
+}
+
+// ScrapeSubstackAPI extracts a Substack post through the publication's post
+// API instead of its HTML, which keeps working when Substack changes markup
+func ScrapeSubstackAPI(ctx context.Context, postURL string) (*Article, error) {
+	post, err := fetchAPIPost(ctx, postURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// An answer from the API confirms a custom domain as Substack. If it was
+	// not known yet, the request went without the session cookie, so paid
+	// posts are requested again with it.
+	if confirmSubstackHost(postURL) && post.isPaid() {
+		if post, err = fetchAPIPost(ctx, postURL); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := goquery.NewDocumentFromReader(strings.NewReader(post.BodyHTML))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse post body: %w", err)
+	}
+
+	// Fail loudly instead of converting the free preview of a paid post
+	truncated := post.isPreview(body)
+	if err := checkSession(truncated, postURL); err != nil {
+		return nil, err
+	}
+
+	// Pick sharp but not oversized images
+	resolveImages(body.Selection, postURL)
+	content, err := body.Find("body").Html()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract content: %w", err)
+	}
+
+	publication := post.publication()
+	article := &Article{
+		Title:         strings.TrimSpace(post.Title),
+		Subtitle:      strings.TrimSpace(post.Subtitle),
+		Description:   strings.TrimSpace(post.Description),
+		Publication:   strings.TrimSpace(publication.Name),
+		Section:       strings.TrimSpace(post.SectionName),
+		Language:      publication.Language,
+		PublishedAt:   post.PostDate.Time,
+		UpdatedAt:     post.UpdatedAt.Time,
+		Content:       content,
+		URL:           post.CanonicalURL,
+		CoverImageURL: post.CoverImage,
+		ImageURLs:     extractImageURLs(body.Selection),
+		Truncated:     truncated,
+	}
+	if article.URL == "" {
+		article.URL = postURL
+	}
+
+	for _, tag := range post.PostTags {
+		if name := strings.TrimSpace(tag.Name); name != "" {
+			article.Tags = append(article.Tags, name)
+		}
+	}
+
+	for _, byline := range post.PublishedBylines {
+		if name := strings.TrimSpace(byline.Name); name != "" {
+			article.Authors = append(article.Authors, name)
+		}
+	}
+	if len(article.Authors) == 0 {
+		article.Author = authorFromSubdomain(postURL)
+	}
+	article.normalizeAuthors()
+
+	return article, nil
+}
+
+// isPreview reports whether the API returned only the free preview of a paid
+// post: the body shows the paywall or is no longer than the teaser
+func (p *apiPost) isPreview(body *goquery.Document) bool {
+	if hasPaywall(body) {
+		return true
+	}
+	if !p.isPaid() {
+		return false
+	}
+	return len(strings.TrimSpace(body.Text())) <= len(strings.TrimSpace(p.TruncatedBodyText))
+}
+
+// isPaid reports whether the post is only for paying subscribers
+func (p *apiPost) isPaid() bool {
+	return p.Audience == "only_paid" || p.Audience == "founding"
+}
+
+// fetchAPIPost requests the post API for the post at postURL
+func fetchAPIPost(ctx context.Context, postURL string) (*apiPost, error) {
+	apiURL, err := postAPIURL(postURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Make HTTP request
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch post API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code from post API: %d", resp.StatusCode)
+	}
+
+	var post apiPost
+	if err := json.NewDecoder(resp.Body).Decode(&post); err != nil {
+		return nil, fmt.Errorf("failed to parse post API response: %w", err)
+	}
+	if post.BodyHTML == "" {
+		return nil, fmt.Errorf("post API returned no body")
+	}
+
+	return &post, nil
+}
+
+// postAPIURL maps https://host/p/slug to https://host/api/v1/posts/slug
+func postAPIURL(postURL string) (string, error) {
+	parsedURL, err := url.Parse(postURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	segments := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] == "p" && segments[i+1] != "" {
+			apiURL := url.URL{
+				Scheme: parsedURL.Scheme,
+				Host:   parsedURL.Host,
+				Path:   "/api/v1/posts/" + segments[i+1],
+			}
+			return apiURL.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: %w", postURL, ErrNoPostSlug)
+}
@@ -0,0 +1,138 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchivePost contains the metadata of a post listed in a publication archive
+type ArchivePost struct {
+	ID           int64     `json:"id"`
+	Title        string    `json:"title"`
+	Subtitle     string    `json:"subtitle"`
+	Slug         string    `json:"slug"`
+	CanonicalURL string    `json:"canonical_url"`
+	PostDate     time.Time `json:"post_date"`
+	Audience     string    `json:"audience"`
+	Type         string    `json:"type"`
+}
+
+// ArchiveOptions contains options for crawling a publication archive
+type ArchiveOptions struct {
+	// Sort is the archive order, either "new" or "top"
+	Sort string
+	// PageSize is the number of posts requested per page
+	PageSize int
+	// MaxPosts stops the crawl after this many posts (0 for no limit)
+	MaxPosts int
+	// Since skips posts published before this time (zero for no bound)
+	Since time.Time
+	// Until skips posts published at or after this time (zero for no bound)
+	Until time.Time
+}
+
+// DefaultArchiveOptions returns the default archive options
+func DefaultArchiveOptions() *ArchiveOptions {
+	return &ArchiveOptions{
+		Sort:     "new",
+		PageSize: 12,
+	}
+}
+
+// CrawlArchive pages through the archive API of a Substack publication and
+// calls fn for every post within the requested date range. Returning an error
+// from fn stops the crawl and returns that error.
+func CrawlArchive(ctx context.Context, publicationURL string, options *ArchiveOptions, fn func(post ArchivePost) error) error {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultArchiveOptions()
+	}
+	if options.Sort != "new" && options.Sort != "top" {
+		return fmt.Errorf("unsupported archive sort order: %s", options.Sort)
+	}
+
+	pageSize := options.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultArchiveOptions().PageSize
+	}
+
+	// A custom domain only gets the session cookie once it is known to be Substack
+	root := strings.TrimRight(publicationURL, "/")
+	authorizeSite(ctx, root)
+
+	yielded := 0
+	for offset := 0; ; offset += pageSize {
+		posts, err := fetchArchivePage(ctx, root, options.Sort, offset, pageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, post := range posts {
+			// The newest-first archive can stop once it is past the range
+			if !options.Since.IsZero() && post.PostDate.Before(options.Since) {
+				if options.Sort == "new" {
+					return nil
+				}
+				continue
+			}
+			if !options.Until.IsZero() && !post.PostDate.Before(options.Until) {
+				continue
+			}
+
+			if post.CanonicalURL == "" {
+				post.CanonicalURL = root + "/p/" + post.Slug
+			}
+
+			if err := fn(post); err != nil {
+				return err
+			}
+
+			yielded++
+			if options.MaxPosts > 0 && yielded >= options.MaxPosts {
+				return nil
+			}
+		}
+
+		// A short page means we reached the end of the archive
+		if len(posts) < pageSize {
+			return nil
+		}
+	}
+}
+
+// fetchArchivePage requests a single page of the archive API
+func fetchArchivePage(ctx context.Context, root, sort string, offset, limit int) ([]ArchivePost, error) {
+	query := url.Values{}
+	query.Set("sort", sort)
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	archiveURL := root + "/api/v1/archive?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	// Make HTTP request
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch archive: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+
+	var posts []ArchivePost
+	if err := json.NewDecoder(resp.Body).Decode(&posts); err != nil {
+		return nil, fmt.Errorf("failed to parse archive page at offset %d: %w", offset, err)
+	}
+
+	return posts, nil
+}
@@ -0,0 +1,280 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"substack-to-kindle/pkg/httpclient"
+)
+
+// archiveServer serves posts from the archive API and records the offsets
+// that were requested
+type archiveServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	offsets []int
+}
+
+// newArchiveServer serves posts in the given order, whatever the sort
+func newArchiveServer(t *testing.T, posts []ArchivePost) *archiveServer {
+	t.Helper()
+	useTestClient(t)
+
+	s := &archiveServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/archive" {
+			http.NotFound(w, r)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		s.mu.Lock()
+		s.offsets = append(s.offsets, offset)
+		s.mu.Unlock()
+
+		page := []ArchivePost{}
+		if offset < len(posts) {
+			page = posts[offset:min(offset+limit, len(posts))]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// useTestClient makes the scraper talk to test servers directly, without
+// the cache, rate limit or retries
+func useTestClient(t *testing.T) {
+	t.Helper()
+	options := httpclient.DefaultOptions()
+	options.CacheDir = ""
+	options.RequestsPerSecond = 0
+	options.MaxRetries = 0
+	if err := UseHTTPOptions(options); err != nil {
+		t.Fatalf("UseHTTPOptions failed: %v", err)
+	}
+}
+
+// newestFirst returns n posts published a day apart, the newest first
+func newestFirst(n int, newest time.Time) []ArchivePost {
+	posts := make([]ArchivePost, n)
+	for i := range posts {
+		posts[i] = ArchivePost{
+			ID:       int64(i + 1),
+			Title:    fmt.Sprintf("Post %d", i),
+			Slug:     fmt.Sprintf("post-%d", i),
+			PostDate: newest.AddDate(0, 0, -i),
+		}
+	}
+	return posts
+}
+
+// crawl collects the slugs of the posts CrawlArchive yields
+func crawl(t *testing.T, server *archiveServer, options *ArchiveOptions) []string {
+	t.Helper()
+	var slugs []string
+	err := CrawlArchive(context.Background(), server.URL+"/", options, func(post ArchivePost) error {
+		if want := server.URL + "/p/" + post.Slug; post.CanonicalURL != want {
+			t.Errorf("post %s has URL %q, want %q", post.Slug, post.CanonicalURL, want)
+		}
+		slugs = append(slugs, post.Slug)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("CrawlArchive failed: %v", err)
+	}
+	return slugs
+}
+
+func TestCrawlArchivePagesThroughArchive(t *testing.T) {
+	newest := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		posts    int
+		pageSize int
+		offsets  []int
+	}{
+		{"short last page", 30, 12, []int{0, 12, 24}},
+		{"full last page", 24, 12, []int{0, 12, 24}},
+		{"single page", 5, 12, []int{0}},
+		{"empty archive", 0, 12, []int{0}},
+		{"default page size", 13, 0, []int{0, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newArchiveServer(t, newestFirst(tt.posts, newest))
+			options := DefaultArchiveOptions()
+			options.PageSize = tt.pageSize
+
+			slugs := crawl(t, server, options)
+			if len(slugs) != tt.posts {
+				t.Errorf("got %d posts, want %d", len(slugs), tt.posts)
+			}
+			for i, slug := range slugs {
+				if want := fmt.Sprintf("post-%d", i); slug != want {
+					t.Errorf("post %d is %s, want %s", i, slug, want)
+					break
+				}
+			}
+			if fmt.Sprint(server.offsets) != fmt.Sprint(tt.offsets) {
+				t.Errorf("requested offsets %v, want %v", server.offsets, tt.offsets)
+			}
+		})
+	}
+}
+
+func TestCrawlArchiveStopsAtMaxPosts(t *testing.T) {
+	server := newArchiveServer(t, newestFirst(30, time.Now()))
+	options := DefaultArchiveOptions()
+	options.PageSize = 10
+	options.MaxPosts = 15
+
+	slugs := crawl(t, server, options)
+	if len(slugs) != 15 {
+		t.Errorf("got %d posts, want 15", len(slugs))
+	}
+	if fmt.Sprint(server.offsets) != "[0 10]" {
+		t.Errorf("requested offsets %v, want [0 10]", server.offsets)
+	}
+}
+
+func TestCrawlArchiveDateRange(t *testing.T) {
+	newest := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	day := func(i int) time.Time { return newest.AddDate(0, 0, -i) }
+
+	// The top posts come in no particular date order
+	top := newestFirst(20, newest)
+	for i, j := range []int{3, 17, 0, 9, 19, 1, 12, 5, 15, 7} {
+		top[i], top[j] = top[j], top[i]
+	}
+
+	tests := []struct {
+		name    string
+		sort    string
+		posts   []ArchivePost
+		since   time.Time
+		until   time.Time
+		want    int
+		offsets string
+	}{
+		// Posts 0 to 4 are within the last five days; the newest-first
+		// archive stops at post 5 instead of reading the other pages
+		{"new since", "new", newestFirst(20, newest), day(4), time.Time{}, 5, "[0]"},
+		{"new since across pages", "new", newestFirst(20, newest), day(7), time.Time{}, 8, "[0 6]"},
+		{"new until", "new", newestFirst(20, newest), time.Time{}, day(14), 5, "[0 6 12 18]"},
+		{"new range", "new", newestFirst(20, newest), day(9), day(2), 7, "[0 6]"},
+		{"top since", "top", top, day(4), time.Time{}, 5, "[0 6 12 18]"},
+		{"top range", "top", top, day(9), day(2), 7, "[0 6 12 18]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newArchiveServer(t, tt.posts)
+			options := DefaultArchiveOptions()
+			options.Sort = tt.sort
+			options.PageSize = 6
+			options.Since = tt.since
+			options.Until = tt.until
+
+			var dates []time.Time
+			err := CrawlArchive(context.Background(), server.URL, options, func(post ArchivePost) error {
+				dates = append(dates, post.PostDate)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("CrawlArchive failed: %v", err)
+			}
+			if len(dates) != tt.want {
+				t.Errorf("got %d posts, want %d", len(dates), tt.want)
+			}
+			for _, date := range dates {
+				if (!tt.since.IsZero() && date.Before(tt.since)) || (!tt.until.IsZero() && !date.Before(tt.until)) {
+					t.Errorf("post of %s is outside the range", date.Format("2006-01-02"))
+				}
+			}
+			if got := fmt.Sprint(server.offsets); got != tt.offsets {
+				t.Errorf("requested offsets %s, want %s", got, tt.offsets)
+			}
+		})
+	}
+}
+
+func TestCrawlArchiveStopsOnCallbackError(t *testing.T) {
+	server := newArchiveServer(t, newestFirst(30, time.Now()))
+	stop := errors.New("stop")
+	count := 0
+	err := CrawlArchive(context.Background(), server.URL, nil, func(post ArchivePost) error {
+		count++
+		if count == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("CrawlArchive returned %v, want the callback's error", err)
+	}
+	if count != 3 || len(server.offsets) != 1 {
+		t.Errorf("crawl went on after the error: %d posts, offsets %v", count, server.offsets)
+	}
+}
+
+func TestCrawlArchiveErrors(t *testing.T) {
+	useTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sort") == "top" {
+			w.Write([]byte("not json"))
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	noop := func(post ArchivePost) error { return nil }
+	if err := CrawlArchive(context.Background(), server.URL, nil, noop); err == nil {
+		t.Error("CrawlArchive succeeded on a bad status")
+	}
+
+	options := DefaultArchiveOptions()
+	options.Sort = "top"
+	if err := CrawlArchive(context.Background(), server.URL, options, noop); err == nil {
+		t.Error("CrawlArchive succeeded on a page that is not JSON")
+	}
+
+	options.Sort = "oldest"
+	if err := CrawlArchive(context.Background(), server.URL, options, noop); err == nil {
+		t.Error("CrawlArchive accepted an unsupported sort order")
+	}
+}
+
+func TestCrawlArchiveSessionCookie(t *testing.T) {
+	server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		if r.URL.Path != "/api/v1/archive" {
+			http.NotFound(w, r)
+			return
+		}
+		posts := newestFirst(3, time.Now())
+		if r.URL.Query().Get("offset") != "0" {
+			posts = nil
+		}
+		json.NewEncoder(w).Encode(posts)
+	})
+
+	options := DefaultArchiveOptions()
+	options.PageSize = 3
+	if err := CrawlArchive(context.Background(), server.URL, options, func(post ArchivePost) error { return nil }); err != nil {
+		t.Fatalf("CrawlArchive failed: %v", err)
+	}
+	// The probe decides whether the site is Substack, so it goes without the cookie
+	want := "/api/v1/archive, /api/v1/archive with cookie, /api/v1/archive with cookie"
+	if got := server.log(); got != want {
+		t.Errorf("requests were %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// trackingParams are query parameters added by newsletters and analytics
+// that never change the page
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+// substackParams are the referral and app parameters Substack adds to post
+// links. The token of paid email links is kept, since it grants access.
+var substackParams = map[string]bool{
+	"r":              true,
+	"s":              true,
+	"source":         true,
+	"triedRedirect":  true,
+	"showWelcome":    true,
+	"publication_id": true,
+	"post_id":        true,
+	"isFreemail":     true,
+}
+
+// appLinkParams identify the post in substack.com/app-link/post links, which
+// have nothing else to tell posts apart, so they are kept there
+var appLinkParams = map[string]bool{
+	"publication_id": true,
+	"post_id":        true,
+}
+
+// postIDPath matches the app links that identify a post by its ID only, as
+// in substack.com/@user/p-12345 and substack.com/home/post/p-12345
+var postIDPath = regexp.MustCompile(`^/(?:@[^/]+|home/post)/p-(\d+)/?$`)
+
+// NormalizeURL cleans up a URL without network access: tracking parameters,
+// Substack's referral parameters and fragments are removed, the host is
+// lower-cased and links to a post's comments point at the post itself.
+// open.substack.com share links and app links are left for CanonicalURL,
+// since only Substack knows which publication they lead to.
+func NormalizeURL(rawURL string) (string, error) {
+	parsedURL, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme: %q", parsedURL.Scheme)
+	}
+
+	parsedURL.Host = strings.ToLower(parsedURL.Host)
+	parsedURL.Fragment = ""
+
+	// Substack's parameters are also dropped from /p/{slug} posts on custom domains
+	segments := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+	substack := IsSubstackHost(parsedURL.Hostname()) || (len(segments) == 2 && segments[0] == "p")
+	appLink := IsAppLink(parsedURL)
+
+	query := parsedURL.Query()
+	for name := range query {
+		if appLink && appLinkParams[name] {
+			continue
+		}
+		if trackingParams[name] || strings.HasPrefix(name, "utm_") || (substack && substackParams[name]) {
+			query.Del(name)
+		}
+	}
+	parsedURL.RawQuery = query.Encode()
+
+	// Posts are shared as /p/{slug}/comments as well
+	if len(segments) == 3 && segments[0] == "p" && segments[2] == "comments" {
+		segments = segments[:2]
+	}
+	parsedURL.Path = "/" + strings.Join(segments, "/")
+	if parsedURL.Path == "/" {
+		parsedURL.Path = ""
+	}
+
+	if IsSubstackHost(parsedURL.Hostname()) {
+		parsedURL.Scheme = "https"
+	}
+	return parsedURL.String(), nil
+}
+
+// IsAppLink reports whether a URL is one of the substack.com/app-link links
+// of Substack's emails, which name the post in their query only
+func IsAppLink(parsedURL *url.URL) bool {
+	return IsSubstackHost(parsedURL.Hostname()) && strings.HasPrefix(parsedURL.Path, "/app-link/")
+}
+
+// CanonicalURL resolves the links Substack's apps and share buttons produce
+// to the canonical URL of the post, following redirects where needed. Links
+// that name the post only by its ID are looked up through the API; other
+// links on substack.com itself are followed to where they lead.
+func CanonicalURL(ctx context.Context, rawURL string) (string, error) {
+	normalized, err := NormalizeURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	parsedURL, err := url.Parse(normalized)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	// Publications live on subdomains or custom domains; only app and
+	// redirect links use substack.com itself
+	host := parsedURL.Hostname()
+	if host != "substack.com" && host != "www.substack.com" && host != "open.substack.com" {
+		return normalized, nil
+	}
+
+	if match := postIDPath.FindStringSubmatch(parsedURL.Path); match != nil {
+		if canonical, err := postURLByID(ctx, match[1]); err == nil {
+			return NormalizeURL(canonical)
+		}
+	}
+
+	resolved, err := followRedirects(ctx, normalized)
+	if err != nil {
+		return "", err
+	}
+	return NormalizeURL(resolved)
+}
+
+// postURLByID asks Substack's API for the canonical URL of a post by its ID
+func postURLByID(ctx context.Context, id string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://substack.com/api/v1/posts/by-id/"+id, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid request: %w", err)
+	}
+
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status code from post API: %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Post struct {
+			CanonicalURL string `json:"canonical_url"`
+		} `json:"post"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("failed to parse post API response: %w", err)
+	}
+	if data.Post.CanonicalURL == "" {
+		return "", fmt.Errorf("post API returned no URL for post %s", id)
+	}
+
+	return data.Post.CanonicalURL, nil
+}
+
+// followRedirects requests a page and returns the URL it ends up at, or the
+// canonical URL the page declares
+func followRedirects(ctx context.Context, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid request: %w", err)
+	}
+
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+
+	resolved := resp.Request.URL.String()
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return resolved, nil
+	}
+	for _, candidate := range []string{
+		doc.Find("link[rel='canonical']").AttrOr("href", ""),
+		doc.Find("meta[property='og:url']").AttrOr("content", ""),
+	} {
+		if canonicalURL, err := resp.Request.URL.Parse(strings.TrimSpace(candidate)); err == nil && candidate != "" {
+			return canonicalURL.String(), nil
+		}
+	}
+
+	return resolved, nil
+}
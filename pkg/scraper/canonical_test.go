@@ -0,0 +1,83 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"clean post", "https://example.substack.com/p/post", "https://example.substack.com/p/post"},
+		{"host is lower-cased", "https://Example.Substack.com/p/post", "https://example.substack.com/p/post"},
+		{"substack.com is always https", "http://example.substack.com/p/post", "https://example.substack.com/p/post"},
+		{"fragment", "https://example.substack.com/p/post#footnote-1", "https://example.substack.com/p/post"},
+		{"referral parameters", "https://example.substack.com/p/post?r=abc&s=w&triedRedirect=true&showWelcome=true", "https://example.substack.com/p/post"},
+		{"tracking parameters", "https://example.com/article?utm_source=x&utm_medium=email&fbclid=1&id=5", "https://example.com/article?id=5"},
+		{"email post parameters", "https://example.substack.com/p/post?publication_id=1&post_id=2&isFreemail=true", "https://example.substack.com/p/post"},
+		{"paid email token is kept", "https://example.substack.com/p/post?token=secret&r=abc", "https://example.substack.com/p/post?token=secret"},
+		{"custom domain post", "https://www.example.com/p/post?r=abc&utm_campaign=x", "https://www.example.com/p/post"},
+		{"other sites keep their parameters", "https://example.com/article?r=1&source=rss", "https://example.com/article?r=1&source=rss"},
+		{"comments link", "https://example.substack.com/p/post/comments?r=abc", "https://example.substack.com/p/post"},
+		{"publication root", "https://example.substack.com/", "https://example.substack.com"},
+		// App links only name the post in their query
+		{"app link", "https://substack.com/app-link/post?publication_id=1&post_id=2&utm_source=post-email-title&isFreemail=true&r=abc", "https://substack.com/app-link/post?post_id=2&publication_id=1"},
+		{"other app link", "https://substack.com/app-link/post?publication_id=1&post_id=3", "https://substack.com/app-link/post?post_id=3&publication_id=1"},
+		// Only Substack knows where share links lead
+		{"share link", "https://open.substack.com/pub/example/p/post?r=abc&utm_medium=ios", "https://open.substack.com/pub/example/p/post"},
+		{"app post ID link", "https://substack.com/@jane/p-12345?utm_source=x", "https://substack.com/@jane/p-12345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeURL(tt.url)
+			if err != nil {
+				t.Fatalf("NormalizeURL(%q) failed: %v", tt.url, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"ftp://example.com/file", "mailto:jane@example.org", "://missing"} {
+		if _, err := NormalizeURL(bad); err == nil {
+			t.Errorf("NormalizeURL(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	useTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/example/p/post":
+			http.Redirect(w, r, "/p/post?r=abc", http.StatusFound)
+		case "/p/post":
+			fmt.Fprint(w, "<html><head></head><body>Post</body></html>")
+		case "/app-link/post":
+			fmt.Fprint(w, `<html><head><link rel="canonical" href="/p/other"></head></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for path, want := range map[string]string{
+		"/pub/example/p/post":            server.URL + "/p/post?r=abc",
+		"/app-link/post?post_id=2&pub=1": server.URL + "/p/other",
+	} {
+		got, err := followRedirects(context.Background(), server.URL+path)
+		if err != nil {
+			t.Fatalf("followRedirects(%s) failed: %v", path, err)
+		}
+		if got != want {
+			t.Errorf("followRedirects(%s) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Comment is a reader comment on a post, with its replies
+type Comment struct {
+	Author  string
+	Body    string
+	Date    time.Time
+	Likes   int
+	Replies []*Comment
+}
+
+// CommentOptions contains options for fetching the comments of a post
+type CommentOptions struct {
+	// Sort is the comment order, either "top" or "new"
+	Sort string
+	// MaxDepth limits how many levels of replies are kept (0 for no limit)
+	MaxDepth int
+	// MaxCount limits the total number of comments kept (0 for no limit)
+	MaxCount int
+}
+
+// DefaultCommentOptions returns the default comment options
+func DefaultCommentOptions() *CommentOptions {
+	return &CommentOptions{
+		Sort:     "top",
+		MaxDepth: 3,
+		MaxCount: 100,
+	}
+}
+
+// apiComment mirrors a comment in Substack's /api/v1/post/{id}/comments response
+type apiComment struct {
+	Name          string         `json:"name"`
+	Body          string         `json:"body"`
+	Date          time.Time      `json:"date"`
+	Deleted       bool           `json:"deleted"`
+	ReactionCount int            `json:"reaction_count"`
+	Reactions     map[string]int `json:"reactions"`
+	Children      []apiComment   `json:"children"`
+}
+
+// likes returns the number of likes, which Substack counts as heart reactions
+func (c apiComment) likes() int {
+	if likes, ok := c.Reactions["❤"]; ok {
+		return likes
+	}
+	return c.ReactionCount
+}
+
+// FetchComments loads the comment thread of a Substack post, sorted and
+// trimmed to the depth and count in options
+func FetchComments(ctx context.Context, postURL string, options *CommentOptions) ([]*Comment, error) {
+	// Use default options if none provided
+	if options == nil {
+		options = DefaultCommentOptions()
+	}
+
+	var apiSort string
+	switch options.Sort {
+	case "top":
+		apiSort = "best_first"
+	case "new":
+		apiSort = "most_recent_first"
+	default:
+		return nil, fmt.Errorf("unsupported comment sort order: %s", options.Sort)
+	}
+
+	// The comments API is keyed by post ID, which only the post API knows
+	post, err := fetchAPIPost(ctx, postURL)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedURL, err := url.Parse(postURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	query := url.Values{}
+	query.Set("all_comments", "true")
+	query.Set("sort", apiSort)
+	commentsURL := url.URL{
+		Scheme:   parsedURL.Scheme,
+		Host:     parsedURL.Host,
+		Path:     fmt.Sprintf("/api/v1/post/%d/comments", post.ID),
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, commentsURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Make HTTP request
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch comments: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code from comments API: %d", resp.StatusCode)
+	}
+
+	var page struct {
+		Comments []apiComment `json:"comments"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to parse comments API response: %w", err)
+	}
+
+	remaining := options.MaxCount
+	if remaining <= 0 {
+		remaining = -1
+	}
+	return buildComments(page.Comments, options, 1, &remaining), nil
+}
+
+// buildComments converts API comments into a sorted thread, stopping at the
+// depth and count limits
+func buildComments(items []apiComment, options *CommentOptions, depth int, remaining *int) []*Comment {
+	if options.MaxDepth > 0 && depth > options.MaxDepth {
+		return nil
+	}
+
+	sorted := append([]apiComment(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if options.Sort == "new" {
+			return sorted[i].Date.After(sorted[j].Date)
+		}
+		return sorted[i].likes() > sorted[j].likes()
+	})
+
+	var comments []*Comment
+	for _, item := range sorted {
+		if *remaining == 0 {
+			break
+		}
+		// Deleted comments only stay to hold their replies together
+		body := strings.TrimSpace(item.Body)
+		if item.Deleted || body == "" {
+			if len(item.Children) == 0 {
+				continue
+			}
+			body = "[deleted]"
+		}
+		if *remaining > 0 {
+			*remaining--
+		}
+
+		comment := &Comment{
+			Author: strings.TrimSpace(item.Name),
+			Body:   body,
+			Date:   item.Date,
+			Likes:  item.likes(),
+		}
+		comment.Replies = buildComments(item.Children, options, depth+1, remaining)
+		comments = append(comments, comment)
+	}
+
+	return comments
+}
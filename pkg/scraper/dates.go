@@ -0,0 +1,148 @@
+package scraper
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// dateLayouts are the date formats found in meta tags, feeds, APIs and on
+// the page, tried in order. Machine-readable formats go first.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC850,
+	time.ANSIC,
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"Monday, January 2, 2006",
+	"Mon, January 2, 2006",
+	"Mon, Jan 2, 2006",
+	"January 2 2006",
+	"Jan 2 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"Monday, 2 January 2006",
+	"2 January, 2006",
+}
+
+// yearlessLayouts are the short dates Substack shows for posts of the current year
+var yearlessLayouts = []string{"January 2", "Jan 2"}
+
+var (
+	// ordinalSuffix matches the suffix of "1st", "22nd" and so on
+	ordinalSuffix = regexp.MustCompile(`\b(\d{1,2})(?:st|nd|rd|th)\b`)
+	// dateLabel matches a label in front of a visible date, as in "Published on March 3, 2024"
+	dateLabel = regexp.MustCompile(`(?i)^(?:published|posted|updated)(?:\s+on)?:?\s*`)
+	// preloadedPostDate matches the post date in the post Substack preloads
+	// into the page as an escaped JSON string
+	preloadedPostDate = regexp.MustCompile(`post_date\\*"\s*:\s*\\*"([^"\\]+)`)
+)
+
+// parseDate parses a date in any of the formats publications use, from ISO
+// 8601 timestamps to human-readable dates like "Mar 3rd, 2024". Dates without
+// a year are taken to be in the past year. Dates without a time are set to
+// noon UTC, so showing them in another time zone keeps the day. The zero time
+// is returned for anything else.
+func parseDate(value string) time.Time {
+	value = strings.Join(strings.Fields(value), " ")
+	value = dateLabel.ReplaceAllString(value, "")
+	value = ordinalSuffix.ReplaceAllString(value, "$1")
+	value = strings.Replace(value, "Sept ", "Sep ", 1)
+	if value == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			if !strings.Contains(layout, "15") {
+				t = t.Add(12 * time.Hour)
+			}
+			return t
+		}
+	}
+
+	now := time.Now()
+	for _, layout := range yearlessLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.AddDate(now.Year()-t.Year(), 0, 0).Add(12 * time.Hour)
+			if t.After(now) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// pageDate looks for the publish date outside the structured metadata: in
+// the post Substack preloads into the page, in time elements and in the
+// visible date line
+func pageDate(doc *goquery.Document) time.Time {
+	var found time.Time
+	doc.Find("script").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if match := preloadedPostDate.FindStringSubmatch(s.Text()); match != nil {
+			found = parseDate(match[1])
+		}
+		return found.IsZero()
+	})
+	if !found.IsZero() {
+		return found
+	}
+
+	for _, attr := range []struct{ selector, name string }{
+		{"[itemprop='datePublished']", "content"},
+		{"[itemprop='datePublished']", "datetime"},
+		{"time[datetime]", "datetime"},
+	} {
+		if t := parseDate(doc.Find(attr.selector).First().AttrOr(attr.name, "")); !t.IsZero() {
+			return t
+		}
+	}
+
+	for _, selector := range []string{"time", ".post-date", ".post-meta .date", ".byline .date", ".date", ".published"} {
+		doc.Find(selector).EachWithBreak(func(i int, s *goquery.Selection) bool {
+			found = parseDate(s.Text())
+			return found.IsZero()
+		})
+		if !found.IsZero() {
+			return found
+		}
+	}
+
+	return time.Time{}
+}
+
+// flexibleTime is a JSON timestamp parsed with parseDate, so an unexpected
+// date format or a null leaves the zero time instead of failing the decode
+type flexibleTime struct {
+	time.Time
+}
+
+func (t *flexibleTime) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		// Not a string, e.g. null
+		t.Time = time.Time{}
+		return nil
+	}
+	t.Time = parseDate(value)
+	return nil
+}
@@ -0,0 +1,81 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// IsSubstackHost reports whether a host is a substack.com subdomain
+func IsSubstackHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "substack.com" || strings.HasSuffix(host, ".substack.com")
+}
+
+// hasSubstackMarkup looks for the generator tag and substackcdn.com assets
+func hasSubstackMarkup(doc *goquery.Document) bool {
+	generator := doc.Find("meta[name='generator']").AttrOr("content", "")
+	if strings.Contains(strings.ToLower(generator), "substack") {
+		return true
+	}
+	return referencesHost(doc, "substackcdn.com")
+}
+
+// referencesHost reports whether any stylesheet, script, image or meta tag
+// of the page points at the given host
+func referencesHost(doc *goquery.Document, host string) bool {
+	found := false
+	doc.Find("link[href], script[src], img[src], meta[content]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		for _, attr := range []string{"href", "src", "content"} {
+			if strings.Contains(s.AttrOr(attr, ""), host) {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+
+	return found
+}
+
+// hasSubstackAPI probes the archive endpoint that every Substack publication serves
+func hasSubstackAPI(ctx context.Context, origin string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/api/v1/archive?limit=1", nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var posts []ArchivePost
+	return json.NewDecoder(resp.Body).Decode(&posts) == nil
+}
+
+// authorizeSite gives the session cookie to a publication on a custom domain
+// once the API probe shows that it is Substack. The probe goes without the
+// cookie, and is skipped for substack.com hosts, domains confirmed before and
+// when no session cookie is configured.
+func authorizeSite(ctx context.Context, siteURL string) {
+	if !needsConfirmation(siteURL) {
+		return
+	}
+	parsedURL, err := url.Parse(siteURL)
+	if err != nil {
+		return
+	}
+	if hasSubstackAPI(ctx, parsedURL.Scheme+"://"+parsedURL.Host) {
+		confirmSubstackHost(siteURL)
+	}
+}
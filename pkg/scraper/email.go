@@ -0,0 +1,367 @@
+package scraper
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	// browserLinkText matches the text of the link to the web version of a newsletter
+	browserLinkText = regexp.MustCompile(`(?i)^(?:view|read|open)\b.*\b(?:browser|online|web)\b`)
+	// quotedFrom matches body lines that mbox writers quoted because they start with "From "
+	quotedFrom = regexp.MustCompile(`^>+From `)
+	// paragraphBreak matches the blank lines between paragraphs of a plain text email
+	paragraphBreak = regexp.MustCompile(`\n[ \t]*\n`)
+)
+
+// emailClutter matches the hidden preview text and tracking pixels newsletters add
+const emailClutter = `[style*="display:none"], [style*="display: none"], img[width="1"], img[height="1"]`
+
+// wordDecoder decodes RFC 2047 encoded headers in any charset
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+// headerGetter is implemented by the headers of messages and of MIME parts
+type headerGetter interface {
+	Get(key string) string
+}
+
+// emailMessage collects the bodies and inline images of an email
+type emailMessage struct {
+	page savedPage
+	// text and textType are the plain text body, used when there is no HTML body
+	text     []byte
+	textType string
+}
+
+// ScrapeEmails reads newsletter emails from an .eml file or an mbox archive
+// and calls fn with the article of every message, or with the error that
+// kept it from being read. The subject, sender and date of the email become
+// the title, author and publish date, and images attached to the message
+// are inlined. Returning an error from fn stops reading.
+func ScrapeEmails(path string, fn func(article *Article, err error) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	fileURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}).String()
+
+	reader := bufio.NewReader(file)
+	start, _ := reader.Peek(5)
+	if string(start) != "From " {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		return fn(scrapeEmail(data, fileURL))
+	}
+
+	count := 0
+	return readMbox(reader, func(message []byte) error {
+		count++
+		article, err := scrapeEmail(message, fmt.Sprintf("%s#%d", fileURL, count))
+		if err != nil {
+			err = fmt.Errorf("message %d: %w", count, err)
+		}
+		return fn(article, err)
+	})
+}
+
+// ScrapeEmail extracts an article from a single email message, as read from
+// a mailbox. Emails that do not link to a web version are identified by a
+// mid: URL of their Message-ID.
+func ScrapeEmail(data []byte) (*Article, error) {
+	return scrapeEmail(data, "")
+}
+
+// readMbox splits an mbox archive into its messages. Each message starts with
+// a "From " separator line; body lines that start with "From " are quoted
+// with ">" and unquoted again here.
+func readMbox(reader *bufio.Reader, fn func(message []byte) error) error {
+	var message bytes.Buffer
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		data := bytes.Clone(message.Bytes())
+		message.Reset()
+		return fn(data)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) {
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+			} else {
+				if quotedFrom.Match(line) {
+					line = line[1:]
+				}
+				message.Write(line)
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read mbox: %w", err)
+		}
+	}
+}
+
+// scrapeEmail extracts an article from a single email message. fallbackURL
+// is the source of articles whose email does not link to a web version; if
+// it is empty, the Message-ID is used.
+func scrapeEmail(data []byte, fallbackURL string) (*Article, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read email headers: %w", err)
+	}
+
+	email := &emailMessage{page: savedPage{resources: make(map[string]string)}}
+	if err := email.readPart(message.Header, message.Body); err != nil {
+		return nil, err
+	}
+	if email.page.html == nil {
+		if email.text == nil {
+			return nil, fmt.Errorf("email has no HTML or text body")
+		}
+		email.page.html, err = plainTextHTML(email.text, email.textType)
+		if err != nil {
+			return nil, err
+		}
+		email.page.contentType = "text/html; charset=utf-8"
+	}
+
+	reader, err := charset.NewReader(bytes.NewReader(email.page.html), email.page.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode HTML: %w", err)
+	}
+	doc, err := goquery.NewDocumentFromReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+	doc.Find(emailClutter).Remove()
+
+	pageURL := emailPostURL(doc, message.Header)
+	if pageURL == "" {
+		pageURL = fallbackURL
+	}
+	if id := strings.Trim(message.Header.Get("Message-ID"), "<> "); pageURL == "" && id != "" {
+		pageURL = "mid:" + url.PathEscape(id)
+	}
+
+	inlineSavedImages(doc.Selection, &email.page, pageURL)
+
+	article, err := extractEmail(doc, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if dataURI, ok := email.page.lookup(article.CoverImageURL, pageURL); ok {
+		article.CoverImageURL = dataURI
+	}
+
+	// The headers say who sent what and when more reliably than the markup
+	if subject := decodeHeader(message.Header.Get("Subject")); subject != "" {
+		article.Title = subject
+	}
+	if author, publication := emailSender(message.Header); author != "" {
+		article.Author = author
+		article.Authors = nil
+		article.normalizeAuthors()
+		if publication != "" {
+			article.Publication = publication
+		}
+	}
+	if date, err := message.Header.Date(); err == nil {
+		article.PublishedAt = date
+	}
+
+	return article, nil
+}
+
+// readPart walks the MIME tree of an email. The first HTML and plain text
+// parts that are not attachments are the bodies; every other part is kept
+// by its Content-ID and Content-Location for cid: and URL references.
+func (e *emailMessage) readPart(header headerGetter, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read email part: %w", err)
+			}
+			if err := e.readPart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Quoted-printable parts are decoded by the multipart reader
+	data, err := decodePart(body, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	attachment := disposition == "attachment"
+	switch {
+	case mediaType == "text/html" && e.page.html == nil && !attachment:
+		e.page.html = data
+		e.page.contentType = contentType
+	case mediaType == "text/plain" && e.text == nil && !attachment:
+		e.text = data
+		e.textType = contentType
+	default:
+		resource := dataURI(mediaType, data)
+		if location := strings.TrimSpace(header.Get("Content-Location")); location != "" {
+			e.page.resources[location] = resource
+		}
+		if id := strings.Trim(header.Get("Content-ID"), "<> "); id != "" {
+			e.page.resources["cid:"+id] = resource
+		}
+	}
+	return nil
+}
+
+// extractEmail picks the extractor for the body of a newsletter email
+func extractEmail(doc *goquery.Document, pageURL string) (*Article, error) {
+	if hasSubstackMarkup(doc) {
+		return extractArticle(doc, pageURL, substackSelectors)
+	}
+	if findReadableContent(doc) != nil {
+		return ExtractReadable(doc, pageURL)
+	}
+
+	// Short emails may not score as an article, so keep the whole body
+	body := doc.Find("body")
+	resolveImages(body, pageURL)
+	content, err := body.Html()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract content: %w", err)
+	}
+	return &Article{
+		URL:       pageURL,
+		Content:   content,
+		ImageURLs: extractImageURLs(body),
+	}, nil
+}
+
+// emailPostURL returns the web version of a newsletter: the Archived-At
+// header, the link of the post title as in Substack's emails, or a "View in
+// browser" link
+func emailPostURL(doc *goquery.Document, header mail.Header) string {
+	candidates := []string{strings.Trim(header.Get("Archived-At"), "<> ")}
+	doc.Find(".post-title a[href], h1 a[href]").Each(func(i int, a *goquery.Selection) {
+		candidates = append(candidates, a.AttrOr("href", ""))
+	})
+	doc.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+		if browserLinkText.MatchString(strings.TrimSpace(a.Text())) {
+			candidates = append(candidates, a.AttrOr("href", ""))
+		}
+	})
+
+	for _, candidate := range candidates {
+		if normalized, err := NormalizeURL(candidate); err == nil {
+			return normalized
+		}
+	}
+	return ""
+}
+
+// emailSender returns the author of an email from its From header. Substack
+// sends as "Jane Doe from Publication", which also gives the publication.
+func emailSender(header mail.Header) (author, publication string) {
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	address, err := parser.Parse(header.Get("From"))
+	if err != nil {
+		return decodeHeader(header.Get("From")), ""
+	}
+	if address.Name == "" {
+		return address.Address, ""
+	}
+
+	_, domain, _ := strings.Cut(address.Address, "@")
+	if IsSubstackHost(strings.ToLower(domain)) {
+		if author, publication, ok := strings.Cut(address.Name, " from "); ok {
+			return strings.TrimSpace(author), strings.TrimSpace(publication)
+		}
+	}
+	return address.Name, ""
+}
+
+// decodeHeader decodes an RFC 2047 encoded header, keeping it as it is if
+// it cannot be decoded
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(decoded)
+}
+
+// plainTextHTML turns a plain text email into HTML with a paragraph for each
+// block of lines
+func plainTextHTML(text []byte, contentType string) ([]byte, error) {
+	reader, err := charset.NewReader(bytes.NewReader(text), contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode text: %w", err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode text: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("<html><body>\n")
+	normalized := strings.ReplaceAll(string(decoded), "\r\n", "\n")
+	for _, paragraph := range paragraphBreak.Split(normalized, -1) {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		lines := strings.Split(html.EscapeString(paragraph), "\n")
+		fmt.Fprintf(&b, "<p>%s</p>\n", strings.Join(lines, "<br/>\n"))
+	}
+	b.WriteString("</body></html>\n")
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,185 @@
+package scraper
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// rssFeed mirrors the parts of a Substack RSS feed that we use
+type rssFeed struct {
+	Channel struct {
+		Title    string    `xml:"title"`
+		Language string    `xml:"language"`
+		Items    []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+// rssItem represents a single post in an RSS feed
+type rssItem struct {
+	Title          string   `xml:"title"`
+	Link           string   `xml:"link"`
+	Description    string   `xml:"description"`
+	Creator        string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	PubDate        string   `xml:"pubDate"`
+	ContentEncoded string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Categories     []string `xml:"category"`
+	Enclosure      struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+// FeedURL returns the RSS feed URL for a Substack publication root
+func FeedURL(publicationURL string) string {
+	publicationURL = strings.TrimRight(publicationURL, "/")
+	if strings.HasSuffix(publicationURL, "/feed") {
+		return publicationURL
+	}
+	return publicationURL + "/feed"
+}
+
+// ScrapeFeed reads the RSS feed of a Substack publication and returns the
+// latest posts as articles. A limit of zero or less returns every item in the feed.
+func ScrapeFeed(ctx context.Context, publicationURL string, limit int) ([]*Article, error) {
+	feedURL := FeedURL(publicationURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	// Make HTTP request, with the session cookie if the site is Substack
+	authorizeSite(ctx, feedURL)
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+
+	// Parse RSS
+	var feed rssFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+
+	items := feed.Channel.Items
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+
+	var articles []*Article
+	for _, item := range items {
+		article, err := articleFromFeedItem(item, feed.Channel.Title, feed.Channel.Language)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read feed item %q: %w", item.Title, err)
+		}
+
+		// Subscribers can read cut-off paid posts in full through the API;
+		// if that fails, the preview is kept and marked as such
+		if article.Truncated && sessionActive() {
+			if full, err := ScrapeSubstackAPI(ctx, article.URL); err == nil {
+				if full.Publication == "" {
+					full.Publication = article.Publication
+				}
+				article = full
+			}
+		}
+		articles = append(articles, article)
+	}
+
+	return articles, nil
+}
+
+// articleFromFeedItem builds an article from an RSS item
+func articleFromFeedItem(item rssItem, publication, language string) (*Article, error) {
+	// The item description is a summary, which may or may not be the
+	// subtitle, so it is only used as the description
+	article := &Article{
+		Title:       strings.TrimSpace(item.Title),
+		Description: strings.TrimSpace(item.Description),
+		Author:      strings.TrimSpace(item.Creator),
+		Publication: strings.TrimSpace(publication),
+		Language:    strings.TrimSpace(language),
+		URL:         strings.TrimSpace(item.Link),
+	}
+
+	// Fall back to the publication name when the item has no creator
+	if article.Author == "" {
+		article.Author = article.Publication
+	}
+	article.normalizeAuthors()
+
+	for _, category := range item.Categories {
+		if category = strings.TrimSpace(category); category != "" {
+			article.Tags = append(article.Tags, category)
+		}
+	}
+	if strings.HasPrefix(item.Enclosure.Type, "image/") {
+		article.CoverImageURL = item.Enclosure.URL
+	}
+
+	// RSS dates should be RFC 1123, but not every feed sticks to it
+	article.PublishedAt = parseDate(item.PubDate)
+
+	// Prefer the full post body over the summary
+	content := item.ContentEncoded
+	summaryOnly := strings.TrimSpace(content) == ""
+	if summaryOnly {
+		content = item.Description
+	}
+
+	// Pick sharp but not oversized images and extract them
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content: %w", err)
+	}
+	// Feeds only carry the preview of paid posts
+	article.Truncated = summaryOnly || isCutOff(doc)
+
+	resolveImages(doc.Selection, item.Link)
+	article.Content, err = doc.Find("body").Html()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract content: %w", err)
+	}
+	article.ImageURLs = extractImageURLs(doc.Selection)
+
+	return article, nil
+}
+
+// cutOffText matches the link or paragraph that ends the cut-off body of a
+// paid post, e.g. "Read more" or "Keep reading with a 7-day free trial"
+var cutOffText = regexp.MustCompile(`(?i)^(read more|continue reading|keep reading)( with a [\w-]+ free trial)?\W*$`)
+
+// isCutOff reports whether the body of a feed item is only the start of the
+// post: it shows the paywall, or a paragraph or link of its own asks to read on
+func isCutOff(doc *goquery.Document) bool {
+	if hasPaywall(doc) {
+		return true
+	}
+	found := false
+	doc.Find("body > *, a").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		found = cutOffText.MatchString(strings.TrimSpace(s.Text()))
+		return !found
+	})
+	return found
+}
+
+// extractImageURLs collects the src of every image inside a selection
+func extractImageURLs(s *goquery.Selection) []string {
+	var imageURLs []string
+	s.Find("img").Each(func(i int, img *goquery.Selection) {
+		if src, exists := img.Attr("src"); exists && src != "" {
+			imageURLs = append(imageURLs, src)
+		}
+	})
+	return imageURLs
+}
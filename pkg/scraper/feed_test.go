@@ -0,0 +1,127 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testFeed is an RSS feed with a single post
+const testFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel><title>News</title><item><title>Post</title><link>https://news.example.com/p/post</link>
+<description>Summary</description><content:encoded><![CDATA[<p>Body</p>]]></content:encoded></item></channel></rss>`
+
+func TestScrapeFeedSessionCookie(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		api  bool
+		want string
+	}{
+		{"substack custom domain", true, "/api/v1/archive, /feed with cookie"},
+		{"other site", false, "/api/v1/archive, /feed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+				switch {
+				case r.URL.Path == "/feed":
+					fmt.Fprint(w, testFeed)
+				case r.URL.Path == "/api/v1/archive" && tt.api:
+					fmt.Fprint(w, "[]")
+				default:
+					http.NotFound(w, r)
+				}
+			})
+
+			if _, err := ScrapeFeed(context.Background(), server.URL, 0); err != nil {
+				t.Fatalf("ScrapeFeed failed: %v", err)
+			}
+			// The probe decides whether the site is Substack, so it goes without the cookie
+			if got := server.log(); got != tt.want {
+				t.Errorf("requests were %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArticleFromFeedItemTruncated(t *testing.T) {
+	full := "<p>The whole post.</p><p>Thanks for reading!</p>"
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"full post", full, false},
+		{"ends with a link to read more elsewhere", "<p>The whole post.</p><p>Read more about this in <a href=\"https://example.com\">my book</a>.</p>", false},
+		{"paywall markup", `<p>Start</p><div class="paywall">Subscribe</div>`, true},
+		{"read more link", `<p>Start</p><p><a href="https://news.example.com/p/post">Read more</a></p>`, true},
+		{"read more with an arrow", `<p>Start</p><a href="https://news.example.com/p/post">Continue reading →</a>`, true},
+		{"free trial prompt", `<p>Start</p><p>Keep reading with a 7-day free trial</p><p><a href="https://news.example.com/subscribe">Subscribe</a></p>`, true},
+		{"summary only", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := rssItem{Title: "Post", Link: "https://news.example.com/p/post", Description: "Summary", ContentEncoded: tt.content}
+			article, err := articleFromFeedItem(item, "News", "en")
+			if err != nil {
+				t.Fatalf("articleFromFeedItem failed: %v", err)
+			}
+			if article.Truncated != tt.want {
+				t.Errorf("Truncated = %v, want %v", article.Truncated, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeFeedReadsPaidPostsWithSession(t *testing.T) {
+	var server *cookieServer
+	server = newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		switch r.URL.Path {
+		case "/feed":
+			feed := strings.Replace(testFeed, "https://news.example.com", server.URL, 1)
+			fmt.Fprint(w, strings.Replace(feed, "<p>Body</p>", `<p>Body</p><p><a href="/p/post">Read more</a></p>`, 1))
+		case "/api/v1/archive":
+			fmt.Fprint(w, "[]")
+		case "/api/v1/posts/post":
+			body := "<p>Body</p>"
+			if loggedIn {
+				body = articleBody
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": 1, "title": "Post", "slug": "post", "audience": "only_paid",
+				"body_html": body, "truncated_body_text": "Body",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	articles, err := ScrapeFeed(context.Background(), server.URL, 0)
+	if err != nil {
+		t.Fatalf("ScrapeFeed failed: %v", err)
+	}
+	if len(articles) != 1 {
+		t.Fatalf("ScrapeFeed returned %d articles, want 1", len(articles))
+	}
+	article := articles[0]
+	if article.Truncated || !strings.Contains(article.Content, "long article") {
+		t.Errorf("ScrapeFeed returned the preview: %q", article.Content)
+	}
+	if article.Publication != "News" {
+		t.Errorf("article lost the publication of the feed: %q", article.Publication)
+	}
+}
+
+func TestArticleFromFeedItemSummary(t *testing.T) {
+	item := rssItem{Title: "Post", Link: "https://news.example.com/p/post", Description: " Summary ", ContentEncoded: "<p>Body</p>"}
+	article, err := articleFromFeedItem(item, "News", "en")
+	if err != nil {
+		t.Fatalf("articleFromFeedItem failed: %v", err)
+	}
+	if article.Description != "Summary" || article.Subtitle != "" {
+		t.Errorf("got description %q and subtitle %q, want the summary as the description only", article.Description, article.Subtitle)
+	}
+}
@@ -0,0 +1,388 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html/charset"
+)
+
+// savedFromURL matches the comments browsers and SingleFile leave at the top
+// of a saved page with the address it was saved from
+var savedFromURL = regexp.MustCompile(`(?i)<!--\s*(?:saved from url=\(\d+\)|page saved with singlefile\s+url:)\s*(\S+)`)
+
+// savedPage is a page read from disk with the resources saved alongside it
+type savedPage struct {
+	html        []byte
+	contentType string
+	url         string
+	// resources maps the absolute URL or cid: of each saved resource to its data URI
+	resources map[string]string
+	// dir is the directory relative resource paths are looked up in
+	dir string
+}
+
+// ScrapeFile extracts an article from a page saved by a browser: an HTML
+// file, an MHTML snapshot or a SingleFile page. Images saved with the page
+// are inlined as data URIs, so the article converts without network access.
+func ScrapeFile(path string) (*Article, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	page := &savedPage{html: data, contentType: "text/html", dir: filepath.Dir(path)}
+	if isMHTML(path, data) {
+		page, err = parseMHTML(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Honour the charset of the page, which saved pages often declare only in a meta tag
+	reader, err := charset.NewReader(bytes.NewReader(page.html), page.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode HTML: %w", err)
+	}
+	doc, err := goquery.NewDocumentFromReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	pageURL := page.url
+	if pageURL == "" {
+		pageURL = savedPageURL(page.html, doc)
+	}
+	if pageURL == "" {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			absPath = path
+		}
+		pageURL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}).String()
+	}
+
+	inlineSavedImages(doc.Selection, page, pageURL)
+
+	article, err := extractSavedPage(doc, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if dataURI, ok := page.lookup(article.CoverImageURL, pageURL); ok {
+		article.CoverImageURL = dataURI
+	}
+
+	return article, nil
+}
+
+// DropRemoteImages removes the images of an article that are not inlined as
+// data URIs, including the cover, so that it converts without network access.
+// It returns the URLs of the images it removed.
+func DropRemoteImages(article *Article) ([]string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(article.Content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content: %w", err)
+	}
+
+	var dropped []string
+	doc.Find("img").Each(func(i int, img *goquery.Selection) {
+		src := img.AttrOr("src", "")
+		if strings.HasPrefix(src, "data:") {
+			return
+		}
+		if src != "" {
+			dropped = append(dropped, src)
+		}
+		if picture := img.ParentsFiltered("picture").First(); picture.Length() > 0 {
+			picture.Remove()
+		} else {
+			img.Remove()
+		}
+	})
+	if len(dropped) > 0 {
+		content, err := doc.Find("body").Html()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract content: %w", err)
+		}
+		article.Content = content
+	}
+
+	var imageURLs []string
+	for _, imageURL := range article.ImageURLs {
+		if strings.HasPrefix(imageURL, "data:") {
+			imageURLs = append(imageURLs, imageURL)
+		}
+	}
+	article.ImageURLs = imageURLs
+
+	if article.CoverImageURL != "" && !strings.HasPrefix(article.CoverImageURL, "data:") {
+		dropped = append(dropped, article.CoverImageURL)
+		article.CoverImageURL = ""
+	}
+
+	return dropped, nil
+}
+
+// extractSavedPage picks the extractor for a saved page from its URL and
+// markup alone, since the page may not be reachable
+func extractSavedPage(doc *goquery.Document, pageURL string) (*Article, error) {
+	if hostMatches(pageURL, "substack.com") || hasSubstackMarkup(doc) {
+		return extractArticle(doc, pageURL, substackSelectors)
+	}
+
+	for _, source := range Sources() {
+		s, ok := source.(selectorSource)
+		if ok && (s.Match(pageURL) || s.MatchPage(context.Background(), pageURL, doc)) {
+			return extractArticle(doc, pageURL, s.selectors)
+		}
+	}
+
+	if findReadableContent(doc) == nil {
+		return nil, fmt.Errorf("saved page: %w", ErrNoSource)
+	}
+	return ExtractReadable(doc, pageURL)
+}
+
+// savedPageURL returns the address a page was saved from, as noted by the
+// browser or SingleFile, or given by its canonical link
+func savedPageURL(data []byte, doc *goquery.Document) string {
+	// The comment is at the top of the file, before any large inlined resources
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	if match := savedFromURL.FindSubmatch(head); match != nil {
+		return string(match[1])
+	}
+
+	for _, candidate := range []string{
+		doc.Find("link[rel='canonical']").AttrOr("href", ""),
+		doc.Find("meta[property='og:url']").AttrOr("content", ""),
+	} {
+		if parsedURL, err := url.Parse(strings.TrimSpace(candidate)); err == nil && parsedURL.IsAbs() {
+			return parsedURL.String()
+		}
+	}
+	return ""
+}
+
+// inlineSavedImages points every image that was saved with the page at its
+// saved copy, choosing among the saved variants of a responsive image.
+// Images that were not saved are left for resolveImages.
+func inlineSavedImages(s *goquery.Selection, page *savedPage, pageURL string) {
+	targetWidth := targetImageWidth()
+	s.Find("img").Each(func(i int, img *goquery.Selection) {
+		picture := img.ParentsFiltered("picture").First()
+
+		var references []imageCandidate
+		picture.Find("source").Each(func(i int, source *goquery.Selection) {
+			references = append(references, parseSrcset(source.AttrOr("srcset", source.AttrOr("data-srcset", "")))...)
+		})
+		references = append(references, parseSrcset(img.AttrOr("data-srcset", ""))...)
+		references = append(references, parseSrcset(img.AttrOr("srcset", ""))...)
+		for _, attr := range []string{"data-src", "data-lazy-src", "data-original"} {
+			if lazy := strings.TrimSpace(img.AttrOr(attr, "")); lazy != "" {
+				references = append(references, imageCandidate{url: lazy})
+			}
+		}
+
+		// An inlined src is only a placeholder if a saved alternative exists
+		var saved []imageCandidate
+		for _, reference := range references {
+			if dataURI, ok := page.lookup(reference.url, pageURL); ok {
+				reference.url = dataURI
+				saved = append(saved, reference)
+			}
+		}
+		src := img.AttrOr("src", "")
+		if len(saved) == 0 && !(strings.HasPrefix(src, "data:") && len(references) > 0) {
+			if dataURI, ok := page.lookup(src, pageURL); ok {
+				saved = append(saved, imageCandidate{url: dataURI})
+			}
+		}
+
+		best := bestImageCandidate(saved, targetWidth)
+		if best == "" {
+			return
+		}
+		img.SetAttr("src", best)
+		for _, attr := range []string{"srcset", "sizes", "data-src", "data-srcset", "data-lazy-src", "data-original", "loading"} {
+			img.RemoveAttr(attr)
+		}
+		if picture.Length() > 0 {
+			picture.ReplaceWithSelection(img)
+		}
+	})
+}
+
+// lookup returns the data URI of a resource saved with the page. Data URIs
+// are returned as they are; other references are resolved against the page
+// URL for MHTML parts and against the directory of the file for files saved
+// next to it.
+func (p *savedPage) lookup(reference, pageURL string) (string, bool) {
+	reference = strings.TrimSpace(reference)
+	if reference == "" {
+		return "", false
+	}
+	if strings.HasPrefix(reference, "data:") {
+		return reference, true
+	}
+
+	if p.resources != nil {
+		if dataURI, ok := p.resources[reference]; ok {
+			return dataURI, true
+		}
+		if base, err := url.Parse(pageURL); err == nil {
+			if resolved, err := base.Parse(reference); err == nil {
+				dataURI, ok := p.resources[resolved.String()]
+				return dataURI, ok
+			}
+		}
+		return "", false
+	}
+
+	// Browsers save the resources of a complete page in a folder next to it
+	parsedURL, err := url.Parse(reference)
+	if err != nil || p.dir == "" {
+		return "", false
+	}
+	var path string
+	switch {
+	case parsedURL.Scheme == "file":
+		path = filepath.FromSlash(parsedURL.Path)
+	case parsedURL.Scheme == "" && parsedURL.Host == "" && !strings.HasPrefix(parsedURL.Path, "/"):
+		path = filepath.Join(p.dir, filepath.FromSlash(parsedURL.Path))
+	default:
+		return "", false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	mediaType := mime.TypeByExtension(filepath.Ext(path))
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(data)
+	}
+	return dataURI(mediaType, data), true
+}
+
+// isMHTML reports whether a file is an MHTML snapshot, by its extension or
+// the MIME headers it starts with
+func isMHTML(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mht", ".mhtml":
+		return true
+	}
+	start := strings.ToLower(string(bytes.TrimSpace(data[:min(len(data), 512)])))
+	return strings.HasPrefix(start, "from:") || strings.HasPrefix(start, "mime-version:")
+}
+
+// parseMHTML reads the HTML document and the saved resources of an MHTML
+// snapshot. The first HTML part is the page; every other part is stored by
+// its Content-Location and Content-ID.
+func parseMHTML(data []byte) (*savedPage, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MHTML headers: %w", err)
+	}
+
+	page := &savedPage{
+		url:       strings.TrimSpace(message.Header.Get("Snapshot-Content-Location")),
+		resources: make(map[string]string),
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MHTML content type: %w", err)
+	}
+
+	// A snapshot of a page without resources may be a single HTML part
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := decodePart(message.Body, message.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		page.html = body
+		page.contentType = message.Header.Get("Content-Type")
+		return page, nil
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MHTML part: %w", err)
+		}
+
+		// Quoted-printable parts are decoded by the multipart reader
+		body, err := decodePart(part, part.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		location := strings.TrimSpace(part.Header.Get("Content-Location"))
+		partType, _, _ := mime.ParseMediaType(contentType)
+		if page.html == nil && partType == "text/html" {
+			page.html = body
+			page.contentType = contentType
+			if page.url == "" {
+				page.url = location
+			}
+			continue
+		}
+
+		resource := dataURI(partType, body)
+		if location != "" {
+			page.resources[location] = resource
+		}
+		if id := strings.Trim(part.Header.Get("Content-ID"), "<> "); id != "" {
+			page.resources["cid:"+id] = resource
+		}
+	}
+
+	if page.html == nil {
+		return nil, fmt.Errorf("MHTML file has no HTML part")
+	}
+	return page, nil
+}
+
+// decodePart reads a MIME part body in the given transfer encoding
+func decodePart(body io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode MIME part: %w", err)
+	}
+	return data, nil
+}
+
+// dataURI encodes a resource as a base64 data URI
+func dataURI(mediaType string, data []byte) string {
+	if mediaType == "" {
+		mediaType = http.DetectContentType(data)
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
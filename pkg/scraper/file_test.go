@@ -0,0 +1,32 @@
+package scraper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDropRemoteImages(t *testing.T) {
+	saved := "data:image/png;base64,iVBORw0KGgo="
+	article := &Article{
+		Content: `<p><img src="` + saved + `"/></p>` +
+			`<p><picture><source srcset="https://cdn.example.com/a.webp"/><img src="https://cdn.example.com/a.jpg"/></picture></p>` +
+			`<p>Text <img src="https://cdn.example.com/b.png"/></p>`,
+		ImageURLs:     []string{saved, "https://cdn.example.com/a.jpg", "https://cdn.example.com/b.png"},
+		CoverImageURL: "https://cdn.example.com/cover.jpg",
+	}
+
+	dropped, err := DropRemoteImages(article)
+	if err != nil {
+		t.Fatalf("DropRemoteImages failed: %v", err)
+	}
+	want := "https://cdn.example.com/a.jpg https://cdn.example.com/b.png https://cdn.example.com/cover.jpg"
+	if got := strings.Join(dropped, " "); got != want {
+		t.Errorf("dropped %s, want %s", got, want)
+	}
+	if strings.Contains(article.Content, "cdn.example.com") || !strings.Contains(article.Content, saved) || !strings.Contains(article.Content, "Text") {
+		t.Errorf("content is %s, want only the saved image and the text", article.Content)
+	}
+	if len(article.ImageURLs) != 1 || article.ImageURLs[0] != saved || article.CoverImageURL != "" {
+		t.Errorf("images are %v with cover %q, want only the saved image", article.ImageURLs, article.CoverImageURL)
+	}
+}
@@ -0,0 +1,202 @@
+package scraper
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DefaultImageWidth is the width in pixels images are picked for unless
+// UseImageWidth sets another. It matches the screen of a Kindle Paperwhite.
+const DefaultImageWidth = 1264
+
+// imageWidth holds the width images are picked for
+var imageWidth = struct {
+	sync.Mutex
+	width int
+}{
+	width: DefaultImageWidth,
+}
+
+// UseImageWidth sets the width in pixels images are picked for from their
+// responsive variants
+func UseImageWidth(width int) error {
+	if width <= 0 {
+		return fmt.Errorf("image width must be a positive number of pixels, not %d", width)
+	}
+
+	imageWidth.Lock()
+	defer imageWidth.Unlock()
+	imageWidth.width = width
+	return nil
+}
+
+// targetImageWidth returns the width set by UseImageWidth
+func targetImageWidth() int {
+	imageWidth.Lock()
+	defer imageWidth.Unlock()
+	return imageWidth.width
+}
+
+// unsupportedImageTypes are picture source types Kindle cannot display
+var unsupportedImageTypes = []string{"image/webp", "image/avif", "image/jxl"}
+
+// imageCandidate is one image URL from a srcset, with its width or pixel
+// density descriptor
+type imageCandidate struct {
+	url     string
+	width   int
+	density float64
+}
+
+// resolveImages points every image in s at the variant closest to the
+// target image width, taking lazy-loading attributes, srcset and picture
+// sources into account. Relative URLs are resolved against the page URL and
+// picture elements are replaced by their resolved image.
+func resolveImages(s *goquery.Selection, pageURL string) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		base = &url.URL{}
+	}
+	targetWidth := targetImageWidth()
+
+	s.Find("img").Each(func(i int, img *goquery.Selection) {
+		var candidates []imageCandidate
+
+		// Sources of a picture element come before its fallback image
+		picture := img.ParentsFiltered("picture").First()
+		picture.Find("source").Each(func(i int, source *goquery.Selection) {
+			if !isSupportedImageType(source.AttrOr("type", "")) {
+				return
+			}
+			candidates = append(candidates, parseSrcset(source.AttrOr("srcset", source.AttrOr("data-srcset", "")))...)
+		})
+		candidates = append(candidates, parseSrcset(img.AttrOr("data-srcset", ""))...)
+		candidates = append(candidates, parseSrcset(img.AttrOr("srcset", ""))...)
+
+		// Lazy-loaded images keep the real source in a data attribute,
+		// while src holds a placeholder
+		src := img.AttrOr("src", "")
+		for _, attr := range []string{"data-src", "data-lazy-src", "data-original"} {
+			if lazy := strings.TrimSpace(img.AttrOr(attr, "")); lazy != "" {
+				src = lazy
+				break
+			}
+		}
+		if strings.HasPrefix(src, "data:") && len(candidates) > 0 {
+			src = ""
+		}
+		if src != "" {
+			candidates = append(candidates, imageCandidate{url: src})
+		}
+
+		if best := bestImageCandidate(candidates, targetWidth); best != "" {
+			if resolved, err := base.Parse(best); err == nil {
+				best = resolved.String()
+			}
+			img.SetAttr("src", best)
+		}
+		for _, attr := range []string{"srcset", "sizes", "data-src", "data-srcset", "data-lazy-src", "data-original", "loading"} {
+			img.RemoveAttr(attr)
+		}
+
+		if picture.Length() > 0 {
+			picture.ReplaceWithSelection(img)
+		}
+	})
+}
+
+// isSupportedImageType reports whether Kindle can display a picture source type
+func isSupportedImageType(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	for _, unsupported := range unsupportedImageTypes {
+		if mimeType == unsupported {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSrcset parses a srcset attribute. URLs may themselves contain commas,
+// as image CDN URLs often do, so a URL only ends at whitespace.
+func parseSrcset(srcset string) []imageCandidate {
+	var candidates []imageCandidate
+	rest := strings.TrimSpace(srcset)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", \t\n\r")
+		if rest == "" {
+			break
+		}
+
+		end := strings.IndexAny(rest, " \t\n\r")
+		if end < 0 {
+			end = len(rest)
+		}
+		candidate := imageCandidate{url: rest[:end]}
+		rest = rest[end:]
+
+		// A URL followed directly by a comma has no descriptor
+		if strings.HasSuffix(candidate.url, ",") {
+			candidate.url = strings.TrimRight(candidate.url, ",")
+		} else {
+			descriptor := rest
+			if comma := strings.Index(rest, ","); comma >= 0 {
+				descriptor = rest[:comma]
+				rest = rest[comma:]
+			} else {
+				rest = ""
+			}
+			descriptor = strings.TrimSpace(descriptor)
+			if strings.HasSuffix(descriptor, "w") {
+				candidate.width, _ = strconv.Atoi(strings.TrimSuffix(descriptor, "w"))
+			} else if strings.HasSuffix(descriptor, "x") {
+				candidate.density, _ = strconv.ParseFloat(strings.TrimSuffix(descriptor, "x"), 64)
+			}
+		}
+
+		if candidate.url != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// bestImageCandidate returns the smallest candidate at least as wide as the
+// target, or the widest one if none is. Without width descriptors the
+// highest pixel density wins, and without any descriptors the first URL.
+func bestImageCandidate(candidates []imageCandidate, targetWidth int) string {
+	var best *imageCandidate
+	for i := range candidates {
+		candidate := &candidates[i]
+		if candidate.width <= 0 {
+			continue
+		}
+		switch {
+		case best == nil:
+			best = candidate
+		case best.width < targetWidth:
+			if candidate.width > best.width {
+				best = candidate
+			}
+		case candidate.width >= targetWidth && candidate.width < best.width:
+			best = candidate
+		}
+	}
+	if best != nil {
+		return best.url
+	}
+
+	for i := range candidates {
+		if best == nil || candidates[i].density > best.density {
+			best = &candidates[i]
+		}
+	}
+	if best != nil {
+		return best.url
+	}
+	return ""
+}
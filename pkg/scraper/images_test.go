@@ -0,0 +1,47 @@
+package scraper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestUseImageWidth(t *testing.T) {
+	t.Cleanup(func() { UseImageWidth(DefaultImageWidth) })
+
+	content := `<img src="small.jpg" srcset="https://cdn.example.com/424.jpg 424w, https://cdn.example.com/848.jpg 848w, https://cdn.example.com/1456.jpg 1456w">`
+	resolve := func() string {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("failed to parse content: %v", err)
+		}
+		resolveImages(doc.Selection, "https://example.substack.com/p/post")
+		return doc.Find("img").AttrOr("src", "")
+	}
+
+	for _, tt := range []struct {
+		width int
+		want  string
+	}{
+		{DefaultImageWidth, "https://cdn.example.com/1456.jpg"},
+		{800, "https://cdn.example.com/848.jpg"},
+		{300, "https://cdn.example.com/424.jpg"},
+	} {
+		if err := UseImageWidth(tt.width); err != nil {
+			t.Fatalf("UseImageWidth(%d) failed: %v", tt.width, err)
+		}
+		if got := resolve(); got != tt.want {
+			t.Errorf("width %d picked %s, want %s", tt.width, got, tt.want)
+		}
+	}
+
+	for _, width := range []int{0, -1} {
+		if err := UseImageWidth(width); err == nil {
+			t.Errorf("UseImageWidth(%d) succeeded", width)
+		}
+	}
+	if got := targetImageWidth(); got != 300 {
+		t.Errorf("an invalid width changed the width to %d", got)
+	}
+}
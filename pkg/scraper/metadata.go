@@ -0,0 +1,228 @@
+package scraper
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// jsonLDArticle mirrors the schema.org Article fields we read from JSON-LD
+type jsonLDArticle struct {
+	Type          interface{}     `json:"@type"`
+	Graph         []jsonLDArticle `json:"@graph"`
+	Headline      string          `json:"headline"`
+	Description   string          `json:"description"`
+	Image         interface{}     `json:"image"`
+	Author        interface{}     `json:"author"`
+	Publisher     interface{}     `json:"publisher"`
+	DatePublished string          `json:"datePublished"`
+	DateModified  string          `json:"dateModified"`
+	Keywords      interface{}     `json:"keywords"`
+	Section       interface{}     `json:"articleSection"`
+	InLanguage    string          `json:"inLanguage"`
+}
+
+// extractMetadata fills the empty metadata fields of an article from
+// OpenGraph tags, JSON-LD and Substack's own markup
+func extractMetadata(doc *goquery.Document, article *Article) {
+	meta := func(selector string) string {
+		return strings.TrimSpace(doc.Find(selector).First().AttrOr("content", ""))
+	}
+
+	// JSON-LD is the most structured source, so it goes first
+	doc.Find("script[type='application/ld+json']").Each(func(i int, s *goquery.Selection) {
+		var data interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &data); err != nil {
+			return
+		}
+		for _, ld := range jsonLDArticles(data) {
+			applyJSONLD(ld, article)
+		}
+	})
+
+	// Substack keeps the subtitle right below the title
+	setIfEmpty(&article.Subtitle, strings.TrimSpace(doc.Find("h3.subtitle, .subtitle").First().Text()))
+
+	// OpenGraph and article meta tags
+	setIfEmpty(&article.Title, meta("meta[property='og:title']"))
+	setIfEmpty(&article.Description, meta("meta[property='og:description']"))
+	setIfEmpty(&article.Description, meta("meta[name='description']"))
+	setIfEmpty(&article.CoverImageURL, meta("meta[property='og:image']"))
+	setIfEmpty(&article.CoverImageURL, meta("meta[name='twitter:image']"))
+	setIfEmpty(&article.Publication, meta("meta[property='og:site_name']"))
+	setIfEmpty(&article.Section, meta("meta[property='article:section']"))
+	setIfEmpty(&article.Language, strings.TrimSpace(doc.Find("html").AttrOr("lang", "")))
+	if locale := meta("meta[property='og:locale']"); locale != "" {
+		setIfEmpty(&article.Language, strings.ReplaceAll(locale, "_", "-"))
+	}
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = parseDate(meta("meta[property='article:published_time']"))
+	}
+	if article.UpdatedAt.IsZero() {
+		article.UpdatedAt = parseDate(meta("meta[property='article:modified_time']"))
+	}
+
+	if len(article.Tags) == 0 {
+		doc.Find("meta[property='article:tag']").Each(func(i int, s *goquery.Selection) {
+			if tag := strings.TrimSpace(s.AttrOr("content", "")); tag != "" {
+				article.Tags = append(article.Tags, tag)
+			}
+		})
+	}
+	if len(article.Tags) == 0 {
+		article.Tags = splitKeywords(meta("meta[name='keywords']"))
+	}
+
+	article.normalizeAuthors()
+}
+
+// applyJSONLD copies the fields of a JSON-LD article into empty article fields
+func applyJSONLD(ld jsonLDArticle, article *Article) {
+	setIfEmpty(&article.Title, strings.TrimSpace(ld.Headline))
+	setIfEmpty(&article.Description, strings.TrimSpace(ld.Description))
+	setIfEmpty(&article.CoverImageURL, firstURL(ld.Image))
+	setIfEmpty(&article.Publication, firstName(ld.Publisher))
+	setIfEmpty(&article.Language, strings.TrimSpace(ld.InLanguage))
+	if article.Section == "" {
+		if sections := stringList(ld.Section); len(sections) > 0 {
+			article.Section = sections[0]
+		}
+	}
+	if len(article.Tags) == 0 {
+		article.Tags = stringList(ld.Keywords)
+	}
+	if len(article.Authors) == 0 {
+		article.Authors = names(ld.Author)
+	}
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = parseDate(ld.DatePublished)
+	}
+	if article.UpdatedAt.IsZero() {
+		article.UpdatedAt = parseDate(ld.DateModified)
+	}
+}
+
+// jsonLDArticles returns the article-like objects in a JSON-LD document,
+// which may be a single object, a list or an @graph
+func jsonLDArticles(data interface{}) []jsonLDArticle {
+	var articles []jsonLDArticle
+	switch value := data.(type) {
+	case []interface{}:
+		for _, item := range value {
+			articles = append(articles, jsonLDArticles(item)...)
+		}
+	case map[string]interface{}:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil
+		}
+		var ld jsonLDArticle
+		if err := json.Unmarshal(raw, &ld); err != nil {
+			return nil
+		}
+		for _, item := range ld.Graph {
+			if isArticleType(item.Type) {
+				articles = append(articles, item)
+			}
+		}
+		if isArticleType(ld.Type) {
+			articles = append(articles, ld)
+		}
+	}
+	return articles
+}
+
+// isArticleType reports whether a JSON-LD @type is one of the article types
+func isArticleType(t interface{}) bool {
+	for _, name := range stringList(t) {
+		if strings.HasSuffix(name, "Article") || name == "BlogPosting" || name == "Report" {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList converts a JSON-LD string, comma-separated string or list to a slice
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return splitKeywords(v)
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+				list = append(list, strings.TrimSpace(s))
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// names returns the names of a JSON-LD person or organization, or a list of them
+func names(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if v = strings.TrimSpace(v); v != "" {
+			return []string{v}
+		}
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok && strings.TrimSpace(name) != "" {
+			return []string{strings.TrimSpace(name)}
+		}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			list = append(list, names(item)...)
+		}
+		return list
+	}
+	return nil
+}
+
+// firstName returns the first name of a JSON-LD person or organization
+func firstName(value interface{}) string {
+	if list := names(value); len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// firstURL returns the first URL of a JSON-LD image, which may be a string,
+// an ImageObject or a list of either
+func firstURL(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]interface{}:
+		if u, ok := v["url"].(string); ok {
+			return strings.TrimSpace(u)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if u := firstURL(item); u != "" {
+				return u
+			}
+		}
+	}
+	return ""
+}
+
+// splitKeywords splits a comma-separated keyword list
+func splitKeywords(keywords string) []string {
+	var list []string
+	for _, keyword := range strings.Split(keywords, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			list = append(list, keyword)
+		}
+	}
+	return list
+}
+
+// setIfEmpty sets a field only if it has no value yet
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
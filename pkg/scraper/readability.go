@@ -0,0 +1,289 @@
+package scraper
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// Scoring follows Mozilla Readability: paragraphs pass their score on to
+// their parent and grandparent, class and id names nudge a node up or down,
+// and a node's final score is reduced by the share of its text inside links.
+var (
+	unlikelyCandidates = regexp.MustCompile(`(?i)banner|breadcrumbs|combx|comment|community|cover-wrap|disqus|extra|footer|gdpr|header|legends|menu|related|remark|replies|rss|shoutbox|sidebar|skyscraper|social|sponsor|supplemental|ad-break|agegate|pagination|pager|popup|yom-remote|share|subscribe|newsletter-signup|promo`)
+	maybeCandidate     = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positiveNames      = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|pagination|post|text|blog|story`)
+	negativeNames      = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+// minReadableLength is the amount of text a candidate needs to count as an article
+const minReadableLength = 140
+
+// genericSource extracts articles from any page with Readability-style scoring.
+// It never matches on the URL alone and is not registered, so it only runs
+// after every registered source has declined the downloaded page.
+type genericSource struct{}
+
+func (genericSource) Name() string {
+	return "Generic"
+}
+
+func (genericSource) Match(url string) bool {
+	return false
+}
+
+func (genericSource) MatchPage(ctx context.Context, url string, doc *goquery.Document) bool {
+	return findReadableContent(doc) != nil
+}
+
+func (genericSource) Fetch(ctx context.Context, url string, doc *goquery.Document) (*Article, error) {
+	if doc == nil {
+		var err error
+		if doc, err = fetchDocument(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+	return ExtractReadable(doc, url)
+}
+
+// ExtractReadable builds an article from any HTML page by scoring its nodes
+// on text and link density, without relying on site-specific selectors
+func ExtractReadable(doc *goquery.Document, pageURL string) (*Article, error) {
+	article := &Article{
+		URL:       pageURL,
+		Title:     readableTitle(doc),
+		Author:    readableAuthor(doc),
+		Truncated: hasPaywall(doc),
+	}
+
+	// Extract subtitle, cover, tags, dates and other metadata
+	extractMetadata(doc, article)
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = pageDate(doc)
+	}
+	if article.Author == "" {
+		article.Author = authorFromSubdomain(pageURL)
+		article.normalizeAuthors()
+	}
+
+	content := findReadableContent(doc)
+	if content == nil {
+		return article, nil
+	}
+
+	resolveImages(content, pageURL)
+	contentHTML, err := content.Html()
+	if err != nil {
+		return nil, err
+	}
+	article.Content = contentHTML
+	article.ImageURLs = extractImageURLs(content)
+
+	return article, nil
+}
+
+// findReadableContent returns a new element holding the best scoring node and
+// its related siblings, or nil if the page has no article-like content
+func findReadableContent(doc *goquery.Document) *goquery.Selection {
+	// Work on a copy so the caller's document is left untouched
+	body := doc.Find("body").First()
+	if body.Length() == 0 {
+		return nil
+	}
+	root := goquery.NewDocumentFromNode(cloneNode(body.Get(0))).Selection
+	prepareForScoring(root)
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+	addScore := func(node *html.Node, score float64) {
+		if node == nil || node.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[node]; !ok {
+			scores[node] = initialScore(node)
+			candidates = append(candidates, node)
+		}
+		scores[node] += score
+	}
+
+	root.Find("p, pre, td, blockquote").Each(func(i int, s *goquery.Selection) {
+		text := strings.TrimSpace(s.Text())
+		if len(text) < 25 {
+			return
+		}
+
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+		parent := s.Get(0).Parent
+		addScore(parent, score)
+		if parent != nil {
+			addScore(parent.Parent, score/2)
+		}
+	})
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Scale by link density and pick the best candidate
+	for _, node := range candidates {
+		scores[node] *= 1 - linkDensity(goquery.NewDocumentFromNode(node).Selection)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i]] > scores[candidates[j]]
+	})
+	top := candidates[0]
+	topSelection := &goquery.Selection{Nodes: []*html.Node{top}}
+	if len(strings.TrimSpace(topSelection.Text())) < minReadableLength {
+		return nil
+	}
+
+	// Siblings that score well, or look like article paragraphs, belong to the content
+	threshold := math.Max(10, scores[top]*0.2)
+	wrapper := goquery.NewDocumentFromNode(&html.Node{Type: html.ElementNode, Data: "div"}).Selection
+	siblings := topSelection.Parent().Children()
+	if top.Parent == nil {
+		siblings = topSelection
+	}
+	siblings.Each(func(i int, s *goquery.Selection) {
+		node := s.Get(0)
+		include := node == top
+		if score, ok := scores[node]; ok && score >= threshold {
+			include = true
+		}
+		if goquery.NodeName(s) == "p" {
+			text := strings.TrimSpace(s.Text())
+			density := linkDensity(s)
+			if (len(text) > 80 && density < 0.25) || (len(text) > 0 && density == 0 && strings.Contains(text, ". ")) {
+				include = true
+			}
+		}
+		if include {
+			wrapper.AppendNodes(cloneNode(node))
+		}
+	})
+
+	return wrapper
+}
+
+// prepareForScoring removes elements that never belong to article content
+func prepareForScoring(root *goquery.Selection) {
+	root.Find("script, style, noscript, nav, header, footer, aside, form, button, iframe, svg").Remove()
+
+	root.Find("*").Each(func(i int, s *goquery.Selection) {
+		tag := goquery.NodeName(s)
+		if tag == "body" || tag == "article" || tag == "main" {
+			return
+		}
+		names := s.AttrOr("class", "") + " " + s.AttrOr("id", "")
+		if unlikelyCandidates.MatchString(names) && !maybeCandidate.MatchString(names) {
+			s.Remove()
+		}
+	})
+}
+
+// initialScore weights a node by its tag and its class and id names
+func initialScore(node *html.Node) float64 {
+	score := 0.0
+	switch node.Data {
+	case "div", "article", "section", "main":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+
+	for _, attr := range node.Attr {
+		if attr.Key != "class" && attr.Key != "id" {
+			continue
+		}
+		if negativeNames.MatchString(attr.Val) {
+			score -= 25
+		}
+		if positiveNames.MatchString(attr.Val) {
+			score += 25
+		}
+	}
+
+	return score
+}
+
+// linkDensity is the share of a selection's text that sits inside links
+func linkDensity(s *goquery.Selection) float64 {
+	textLength := len(strings.TrimSpace(s.Text()))
+	if textLength == 0 {
+		return 0
+	}
+
+	linkLength := 0
+	s.Find("a").Each(func(i int, a *goquery.Selection) {
+		linkLength += len(strings.TrimSpace(a.Text()))
+	})
+
+	return float64(linkLength) / float64(textLength)
+}
+
+// readableTitle picks the title from OpenGraph, the first heading or the page title
+func readableTitle(doc *goquery.Document) string {
+	candidates := []string{
+		doc.Find("meta[property='og:title']").AttrOr("content", ""),
+		doc.Find("meta[name='twitter:title']").AttrOr("content", ""),
+		doc.Find("article h1, main h1").First().Text(),
+		doc.Find("h1").First().Text(),
+	}
+	for _, title := range candidates {
+		if title = strings.TrimSpace(title); title != "" {
+			return title
+		}
+	}
+
+	// Drop the site name from titles like "Post | Site"
+	title := strings.TrimSpace(doc.Find("title").First().Text())
+	for _, separator := range []string{" | ", " - ", " — "} {
+		if i := strings.LastIndex(title, separator); i > 0 {
+			return strings.TrimSpace(title[:i])
+		}
+	}
+	return title
+}
+
+// readableAuthor looks for the author in meta tags and common byline markup
+func readableAuthor(doc *goquery.Document) string {
+	for _, selector := range []string{"meta[name='author']", "meta[property='article:author']"} {
+		author := strings.TrimSpace(doc.Find(selector).AttrOr("content", ""))
+		if author != "" && !strings.HasPrefix(author, "http") {
+			return author
+		}
+	}
+
+	for _, selector := range []string{"[rel='author']", "[itemprop='author']", ".author", ".byline"} {
+		author := strings.TrimSpace(doc.Find(selector).First().Text())
+		if author != "" && len(author) < 100 {
+			return strings.TrimPrefix(author, "By ")
+		}
+	}
+
+	return ""
+}
+
+// cloneNode returns a deep copy of an HTML node without its parent and siblings
+func cloneNode(node *html.Node) *html.Node {
+	clone := &html.Node{
+		Type:      node.Type,
+		DataAtom:  node.DataAtom,
+		Data:      node.Data,
+		Namespace: node.Namespace,
+		Attr:      append([]html.Attribute(nil), node.Attr...),
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		clone.AppendChild(cloneNode(child))
+	}
+	return clone
+}
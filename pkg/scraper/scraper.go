@@ -1,6 +1,8 @@
 package scraper
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,17 +14,106 @@ import (
 // Article represents a Substack article with its content
 type Article struct {
 	Title       string
-	Author      string
-	PublishedAt time.Time
-	Content     string
-	URL         string
-	ImageURLs   []string
+	Subtitle    string
+	Description string
+	// Author is the display form of Authors, e.g. "Jane Doe, John Roe"
+	Author        string
+	Authors       []string
+	Publication   string
+	Section       string
+	Tags          []string
+	Language      string
+	PublishedAt   time.Time
+	UpdatedAt     time.Time
+	Content       string
+	URL           string
+	CoverImageURL string
+	ImageURLs     []string
+	// Comments is the comment thread, only loaded on request
+	Comments []*Comment
+	// Truncated is set when the post is paywalled and Content only holds
+	// the free preview
+	Truncated bool
 }
 
-// ScrapeSubstack extracts content from a Substack article URL
-func ScrapeSubstack(url string) (*Article, error) {
+// normalizeAuthors keeps Author and Authors consistent with each other
+func (a *Article) normalizeAuthors() {
+	if len(a.Authors) > 1 {
+		a.Author = strings.Join(a.Authors, ", ")
+	} else if len(a.Authors) == 1 && a.Author == "" {
+		a.Author = a.Authors[0]
+	} else if len(a.Authors) == 0 && a.Author != "" {
+		a.Authors = []string{a.Author}
+	}
+}
+
+// selectorSet describes where a newsletter platform keeps the parts of a post
+type selectorSet struct {
+	// Title selectors, tried in order
+	Title []string
+	// Author selectors, tried in order; meta tags are read from their content
+	Author []string
+	// Content selector for the post body
+	Content string
+	// AuthorFromURL derives an author when no selector matches
+	AuthorFromURL func(url string) string
+}
+
+// substackSelectors is the selector set for Substack posts
+var substackSelectors = selectorSet{
+	Title: []string{"h1.post-title", "h1"},
+	Author: []string{
+		".byline-link",
+		".author-name",
+		".substack-author",
+		".post-header .author",
+		"meta[name='author']",
+	},
+	Content:       ".available-content, .subscriber-content, .post-content, .body",
+	AuthorFromURL: authorFromSubdomain,
+}
+
+// ScrapeSubstack extracts content from a Substack article URL. The post API
+// is tried first and the HTML page is only scraped when the API is unavailable.
+func ScrapeSubstack(ctx context.Context, url string) (*Article, error) {
+	return scrapeSubstack(ctx, url, nil)
+}
+
+// scrapeSubstack is ScrapeSubstack with the page, if it was already downloaded
+func scrapeSubstack(ctx context.Context, url string, doc *goquery.Document) (*Article, error) {
+	article, err := ScrapeSubstackAPI(ctx, url)
+	if err == nil || errors.Is(err, ErrSessionExpired) {
+		return article, err
+	}
+
+	// Lookup downloaded the page before it knew the host was Substack, so
+	// without the session cookie; download paid posts again with it
+	if doc != nil && hasPaywall(doc) && hasSessionCookie() {
+		doc = nil
+	}
+	if doc == nil {
+		if doc, err = fetchDocument(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fail loudly instead of converting the free preview of a paid post
+	if err := checkSession(hasPaywall(doc), url); err != nil {
+		return nil, err
+	}
+
+	return extractArticle(doc, url, substackSelectors)
+}
+
+// fetchDocument downloads and parses an HTML page
+func fetchDocument(ctx context.Context, url string) (*goquery.Document, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
 	// Make HTTP request
-	resp, err := http.Get(url)
+	resp, err := HTTPClient().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch URL: %w", err)
 	}
@@ -38,27 +129,27 @@ func ScrapeSubstack(url string) (*Article, error) {
 		return nil, fmt.Errorf("failed to parse HTML: %w", err)
 	}
 
+	return doc, nil
+}
+
+// extractArticle builds an article from a parsed page using a selector set
+func extractArticle(doc *goquery.Document, url string, selectors selectorSet) (*Article, error) {
 	article := &Article{
-		URL: url,
+		URL:       url,
+		Truncated: hasPaywall(doc),
 	}
 
 	// Extract title
-	article.Title = strings.TrimSpace(doc.Find("h1.post-title").Text())
-	if article.Title == "" {
-		article.Title = strings.TrimSpace(doc.Find("h1").First().Text())
+	for _, selector := range selectors.Title {
+		article.Title = strings.TrimSpace(doc.Find(selector).First().Text())
+		if article.Title != "" {
+			break
+		}
 	}
 
 	// Extract author - try multiple selectors
-	authorSelectors := []string{
-		".byline-link",
-		".author-name",
-		".substack-author",
-		".post-header .author",
-		"meta[name='author']",
-	}
-
-	for _, selector := range authorSelectors {
-		if selector == "meta[name='author']" {
+	for _, selector := range selectors.Author {
+		if strings.HasPrefix(selector, "meta") {
 			// Special case for meta tag
 			author, exists := doc.Find(selector).Attr("content")
 			if exists && author != "" {
@@ -66,7 +157,7 @@ func ScrapeSubstack(url string) (*Article, error) {
 				break
 			}
 		} else {
-			author := strings.TrimSpace(doc.Find(selector).Text())
+			author := strings.TrimSpace(doc.Find(selector).First().Text())
 			if author != "" {
 				article.Author = author
 				break
@@ -74,40 +165,49 @@ func ScrapeSubstack(url string) (*Article, error) {
 		}
 	}
 
-	// If author is still empty, try to extract from URL
-	if article.Author == "" {
-		parts := strings.Split(url, "//")
-		if len(parts) > 1 {
-			domainParts := strings.Split(parts[1], ".")
-			if len(domainParts) > 0 {
-				article.Author = strings.Split(domainParts[0], "/")[0]
-			}
-		}
-	}
-
-	// Extract publish date
-	dateStr := doc.Find("time").AttrOr("datetime", "")
-	if dateStr != "" {
-		publishDate, err := time.Parse(time.RFC3339, dateStr)
-		if err == nil {
-			article.PublishedAt = publishDate
+	// Extract content, scoring the page instead when the selectors miss the post body
+	content := doc.Find(selectors.Content)
+	if contentLength := len(strings.TrimSpace(content.Text())); contentLength < minReadableLength {
+		readable := findReadableContent(doc)
+		if readable != nil && len(strings.TrimSpace(readable.Text())) > contentLength {
+			content = readable
 		}
 	}
 
-	// Extract content
-	contentSelector := ".available-content, .subscriber-content, .post-content, .body"
-	contentHTML, err := doc.Find(contentSelector).Html()
+	// Pick sharp but not oversized images
+	resolveImages(content, url)
+	contentHTML, err := content.Html()
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract content: %w", err)
 	}
 	article.Content = contentHTML
 
 	// Extract images
-	doc.Find(contentSelector + " img").Each(func(i int, s *goquery.Selection) {
-		if src, exists := s.Attr("src"); exists && src != "" {
-			article.ImageURLs = append(article.ImageURLs, src)
-		}
-	})
+	article.ImageURLs = extractImageURLs(content)
+
+	// Extract subtitle, cover, tags, dates and other metadata
+	extractMetadata(doc, article)
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = pageDate(doc)
+	}
+
+	// If author is still empty, try to extract from URL
+	if article.Author == "" && selectors.AuthorFromURL != nil {
+		article.Author = selectors.AuthorFromURL(url)
+		article.normalizeAuthors()
+	}
 
 	return article, nil
 }
+
+// authorFromSubdomain uses the first label of the host as the author
+func authorFromSubdomain(url string) string {
+	parts := strings.Split(url, "//")
+	if len(parts) > 1 {
+		domainParts := strings.Split(parts[1], ".")
+		if len(domainParts) > 0 {
+			return strings.Split(domainParts[0], "/")[0]
+		}
+	}
+	return ""
+}
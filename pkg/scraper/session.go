@@ -0,0 +1,273 @@
+package scraper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"substack-to-kindle/pkg/httpclient"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// SessionCookieName is the name of the cookie Substack uses for logged-in readers
+const SessionCookieName = "substack.sid"
+
+// ErrPaywalled is returned for paywalled posts of which only the free
+// preview could be read
+var ErrPaywalled = errors.New("only the free preview of this paywalled post is available")
+
+// ErrSessionExpired is returned when a session is configured but Substack
+// still shows the paywall, which usually means the cookie has expired. It
+// wraps ErrPaywalled.
+var ErrSessionExpired = fmt.Errorf("%w with the configured session; the cookie has probably expired, log in again and update SUBSTACK_SID", ErrPaywalled)
+
+// SessionConfig contains the credentials used to read subscriber-only posts
+type SessionConfig struct {
+	// SubstackSID is the value of the substack.sid cookie of a logged-in browser
+	SubstackSID string
+	// CookieFile is the path to a cookies.txt file in Netscape format
+	CookieFile string
+}
+
+// session holds the HTTP client shared by all scraper and image requests
+var session = struct {
+	sync.Mutex
+	client  *http.Client
+	options httpclient.Options
+	sid     string
+	active  bool
+	// hosts are the custom domains confirmed to serve a Substack publication
+	hosts map[string]bool
+}{
+	options: *httpclient.DefaultOptions(),
+}
+
+// LoadSessionConfigFromEnv loads session credentials from environment variables
+func LoadSessionConfigFromEnv() SessionConfig {
+	return SessionConfig{
+		SubstackSID: os.Getenv("SUBSTACK_SID"),
+		CookieFile:  os.Getenv("SUBSTACK_COOKIE_FILE"),
+	}
+}
+
+// UseSession installs the given credentials on the shared HTTP client.
+// Cookies are stored in a cookie jar, so they are only sent to the hosts
+// they belong to. The substack.sid cookie belongs to substack.com and its
+// subdomains, and to custom domains once they are confirmed as Substack
+// publications. An empty configuration leaves the client unauthenticated.
+func UseSession(config SessionConfig) error {
+	if config.SubstackSID == "" && config.CookieFile == "" {
+		return nil
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+
+	if config.CookieFile != "" {
+		if err := loadCookieFile(jar, config.CookieFile); err != nil {
+			return err
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	options := session.options
+	options.Jar = jar
+	if err := useClientOptions(options); err != nil {
+		return err
+	}
+	session.sid = config.SubstackSID
+	session.active = true
+	session.hosts = make(map[string]bool)
+	addSessionCookie("substack.com", true)
+
+	return nil
+}
+
+// UseHTTPOptions configures timeouts, retries, rate limits, the User-Agent
+// and the proxy of the shared HTTP client. The session cookies are kept.
+func UseHTTPOptions(options *httpclient.Options) error {
+	session.Lock()
+	defer session.Unlock()
+
+	updated := *options
+	if updated.Jar == nil {
+		updated.Jar = session.options.Jar
+	}
+	return useClientOptions(updated)
+}
+
+// useClientOptions replaces the shared HTTP client. The session lock must be held.
+func useClientOptions(options httpclient.Options) error {
+	client, err := httpclient.New(&options)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP client: %w", err)
+	}
+	session.client = client
+	session.options = options
+	return nil
+}
+
+// HTTPClient returns the client used for all scraper and image requests
+func HTTPClient() *http.Client {
+	session.Lock()
+	defer session.Unlock()
+	if session.client == nil {
+		// The default options cannot fail
+		session.client, _ = httpclient.New(&session.options)
+	}
+	return session.client
+}
+
+// confirmSubstackHost records that the host of a URL serves a Substack
+// publication, so it gets the session cookie from now on. Custom domains only
+// get the cookie through here, once their markup or API showed that the site
+// is Substack. It reports whether
+// the cookie was added by this call, i.e. whether earlier requests to the
+// host went without it.
+func confirmSubstackHost(pageURL string) bool {
+	host := urlHost(pageURL)
+	if host == "" {
+		return false
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	if session.sid == "" || IsSubstackHost(host) || session.hosts[host] {
+		return false
+	}
+	session.hosts[host] = true
+	addSessionCookie(host, false)
+	return true
+}
+
+// needsConfirmation reports whether the session cookie would only be sent
+// to the host of a URL after confirmSubstackHost
+func needsConfirmation(pageURL string) bool {
+	host := urlHost(pageURL)
+	if host == "" || IsSubstackHost(host) {
+		return false
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	return session.sid != "" && !session.hosts[host]
+}
+
+// hasSessionCookie reports whether a substack.sid cookie is configured
+func hasSessionCookie() bool {
+	session.Lock()
+	defer session.Unlock()
+	return session.sid != ""
+}
+
+// urlHost returns the lower-case host name of a URL, or "" if it has none
+func urlHost(pageURL string) string {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedURL.Hostname())
+}
+
+// addSessionCookie stores the substack.sid cookie for a domain. The session
+// lock must be held.
+func addSessionCookie(domain string, includeSubdomains bool) {
+	if session.sid == "" || session.options.Jar == nil {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:   SessionCookieName,
+		Value:  session.sid,
+		Path:   "/",
+		Secure: true,
+	}
+	if includeSubdomains {
+		cookie.Domain = domain
+	}
+	session.options.Jar.SetCookies(&url.URL{Scheme: "https", Host: domain, Path: "/"}, []*http.Cookie{cookie})
+}
+
+// loadCookieFile adds the cookies of a Netscape cookies.txt file to a jar
+func loadCookieFile(jar http.CookieJar, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Browsers mark HttpOnly cookies with a prefix on an otherwise commented line
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("invalid cookie file line %d: expected 7 tab-separated fields", lineNumber)
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:   fields[5],
+			Value:  fields[6],
+			Path:   fields[2],
+			Secure: strings.EqualFold(fields[3], "TRUE"),
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+		if expiry, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+
+		jar.SetCookies(&url.URL{Scheme: "https", Host: domain, Path: "/"}, []*http.Cookie{cookie})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	return nil
+}
+
+// sessionActive reports whether credentials are configured
+func sessionActive() bool {
+	session.Lock()
+	defer session.Unlock()
+	return session.active
+}
+
+// checkSession returns ErrSessionExpired when a session is configured but
+// only the preview of a paywalled post could be read
+func checkSession(paywalled bool, pageURL string) error {
+	if sessionActive() && paywalled {
+		return fmt.Errorf("%s: %w", pageURL, ErrSessionExpired)
+	}
+	return nil
+}
+
+// hasPaywall reports whether the page contains the paywall block of Substack
+// or the upgrade prompt Ghost shows instead of members-only content
+func hasPaywall(doc *goquery.Document) bool {
+	return doc.Find(".paywall, [data-testid='paywall'], .paywall-title, .gh-post-upgrade-cta").Length() > 0
+}
@@ -0,0 +1,92 @@
+package scraper
+
+import (
+	"net/url"
+	"testing"
+)
+
+// useTestSession logs the test client in with a substack.sid cookie and
+// logs it out again when the test ends
+func useTestSession(t *testing.T, sid string) {
+	t.Helper()
+	useTestClient(t)
+	if err := UseSession(SessionConfig{SubstackSID: sid}); err != nil {
+		t.Fatalf("UseSession failed: %v", err)
+	}
+	t.Cleanup(func() {
+		session.Lock()
+		defer session.Unlock()
+		session.options.Jar = nil
+		session.sid = ""
+		session.active = false
+		session.hosts = nil
+		useClientOptions(session.options)
+	})
+}
+
+// sessionCookie returns the substack.sid cookie the jar sends to a URL
+func sessionCookie(t *testing.T, pageURL string) string {
+	t.Helper()
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", pageURL, err)
+	}
+	for _, cookie := range HTTPClient().Jar.Cookies(parsedURL) {
+		if cookie.Name == SessionCookieName {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestSessionCookieHosts(t *testing.T) {
+	useTestSession(t, "SECRET")
+
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"https://substack.com/home", "SECRET"},
+		{"https://jane.substack.com/p/post", "SECRET"},
+		{"https://example.com/p/post", ""},
+		{"https://notsubstack.com/", ""},
+		{"https://substack.com.evil.example/", ""},
+		{"https://substackcdn.com/image/fetch/x.png", ""},
+		// Secure cookies never go over plain HTTP
+		{"http://jane.substack.com/p/post", ""},
+	} {
+		if got := sessionCookie(t, tt.url); got != tt.want {
+			t.Errorf("cookie for %s = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestConfirmSubstackHost(t *testing.T) {
+	useTestSession(t, "SECRET")
+
+	if !confirmSubstackHost("https://News.Example.com/p/post") {
+		t.Error("confirmSubstackHost did not add the cookie for a new custom domain")
+	}
+	if confirmSubstackHost("https://news.example.com/p/other") {
+		t.Error("confirmSubstackHost added the cookie twice")
+	}
+	if confirmSubstackHost("https://jane.substack.com/p/post") {
+		t.Error("confirmSubstackHost added a cookie substack.com already covers")
+	}
+
+	if got := sessionCookie(t, "https://news.example.com/archive"); got != "SECRET" {
+		t.Errorf("cookie for the confirmed domain = %q, want SECRET", got)
+	}
+	for _, other := range []string{"https://example.com/", "https://www.news.example.com/"} {
+		if got := sessionCookie(t, other); got != "" {
+			t.Errorf("cookie for %s = %q, want none", other, got)
+		}
+	}
+}
+
+func TestConfirmSubstackHostWithoutSession(t *testing.T) {
+	useTestClient(t)
+	if confirmSubstackHost("https://news.example.com/p/post") {
+		t.Error("confirmSubstackHost reported a cookie without a session")
+	}
+}
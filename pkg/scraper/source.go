@@ -0,0 +1,271 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ErrNoSource is returned when no registered source can handle a URL
+var ErrNoSource = errors.New("no source can handle this URL")
+
+// Source extracts articles from one newsletter platform
+type Source interface {
+	// Name returns the name of the platform
+	Name() string
+	// Match reports whether the URL belongs to the platform, without network access
+	Match(url string) bool
+	// Fetch extracts the article at the URL. doc is the page if Lookup
+	// already downloaded it, or nil if the source has to download it.
+	Fetch(ctx context.Context, url string, doc *goquery.Document) (*Article, error)
+}
+
+// PageMatcher is implemented by sources that can also recognise their
+// platform from the markup of a downloaded page, such as publications on a
+// custom domain. MatchPage must not make requests of its own.
+type PageMatcher interface {
+	MatchPage(ctx context.Context, url string, doc *goquery.Document) bool
+}
+
+// SiteProber is implemented by sources that can recognise their platform by
+// requests to the site, e.g. to an API endpoint. Probes only run once no
+// source recognised the page from its markup.
+type SiteProber interface {
+	ProbeSite(ctx context.Context, url string) bool
+}
+
+// registry holds the registered sources in the order they are tried
+var registry struct {
+	sync.RWMutex
+	sources []Source
+}
+
+func init() {
+	Register(substackSource{})
+	Register(ghostSource)
+	Register(buttondownSource)
+	Register(beehiivSource)
+}
+
+// fallbackSource is used for pages no registered source recognises. The
+// generic extractor accepts any page with article-like content, so it is
+// kept out of the registry to let the sources there probe the site first.
+var fallbackSource Source = genericSource{}
+
+// Register adds a source to the registry. Sources are tried in the order
+// they were registered.
+func Register(source Source) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sources = append(registry.sources, source)
+}
+
+// Sources returns the registered sources
+func Sources() []Source {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]Source(nil), registry.sources...)
+}
+
+// Lookup returns the source for a URL. Sources are first matched on the URL
+// alone; if none matches, the page is downloaded once and offered to the
+// sources that implement PageMatcher, then to those that implement
+// SiteProber, and finally to the generic extractor. The downloaded page is
+// returned for the source's Fetch, or nil if the URL alone was enough.
+func Lookup(ctx context.Context, pageURL string) (Source, *goquery.Document, error) {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, nil, fmt.Errorf("unsupported URL scheme: %q", parsedURL.Scheme)
+	}
+
+	sources := Sources()
+	for _, source := range sources {
+		if source.Match(pageURL) {
+			return source, nil, nil
+		}
+	}
+
+	doc, err := fetchDocument(ctx, pageURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The markup is already here, so check all of it before probing the site
+	for _, source := range sources {
+		if matcher, ok := source.(PageMatcher); ok && matcher.MatchPage(ctx, pageURL, doc) {
+			return source, doc, nil
+		}
+	}
+	for _, source := range sources {
+		if prober, ok := source.(SiteProber); ok && prober.ProbeSite(ctx, pageURL) {
+			return source, doc, nil
+		}
+	}
+	if matcher, ok := fallbackSource.(PageMatcher); ok && matcher.MatchPage(ctx, pageURL, doc) {
+		return fallbackSource, doc, nil
+	}
+
+	return nil, nil, fmt.Errorf("%s: %w", parsedURL.Host, ErrNoSource)
+}
+
+// Fetch extracts the article at a URL with the matching source
+func Fetch(ctx context.Context, url string) (*Article, error) {
+	source, doc, err := Lookup(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return source.Fetch(ctx, url, doc)
+}
+
+// substackSource handles Substack publications, including custom domains
+type substackSource struct{}
+
+func (substackSource) Name() string {
+	return "Substack"
+}
+
+func (substackSource) Match(url string) bool {
+	return hostMatches(url, "substack.com")
+}
+
+// MatchPage recognises custom domains by their markup. A match lets the host
+// have the session cookie.
+func (substackSource) MatchPage(ctx context.Context, pageURL string, doc *goquery.Document) bool {
+	if !hasSubstackMarkup(doc) {
+		return false
+	}
+	confirmSubstackHost(pageURL)
+	return true
+}
+
+// ProbeSite recognises custom themes that hide the markup, since the API is
+// always there. The probe goes without the session cookie.
+func (substackSource) ProbeSite(ctx context.Context, pageURL string) bool {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return false
+	}
+	if !hasSubstackAPI(ctx, parsedURL.Scheme+"://"+parsedURL.Host) {
+		return false
+	}
+	confirmSubstackHost(pageURL)
+	return true
+}
+
+func (substackSource) Fetch(ctx context.Context, url string, doc *goquery.Document) (*Article, error) {
+	return scrapeSubstack(ctx, url, doc)
+}
+
+// selectorSource handles platforms that only need a selector set
+type selectorSource struct {
+	name      string
+	hosts     []string
+	generator string
+	assetHost string
+	selectors selectorSet
+}
+
+func (s selectorSource) Name() string {
+	return s.name
+}
+
+func (s selectorSource) Match(url string) bool {
+	return hostMatches(url, s.hosts...)
+}
+
+func (s selectorSource) MatchPage(ctx context.Context, url string, doc *goquery.Document) bool {
+	generator := doc.Find("meta[name='generator']").AttrOr("content", "")
+	if s.generator != "" && strings.Contains(strings.ToLower(generator), s.generator) {
+		return true
+	}
+	return s.assetHost != "" && referencesHost(doc, s.assetHost)
+}
+
+func (s selectorSource) Fetch(ctx context.Context, url string, doc *goquery.Document) (*Article, error) {
+	if doc == nil {
+		var err error
+		if doc, err = fetchDocument(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+	return extractArticle(doc, url, s.selectors)
+}
+
+// ghostSource handles Ghost blogs on ghost.io and custom domains
+var ghostSource = selectorSource{
+	name:      "Ghost",
+	hosts:     []string{"ghost.io"},
+	generator: "ghost",
+	selectors: selectorSet{
+		Title: []string{"h1.article-title", "h1.gh-article-title", "h1.post-full-title", "h1"},
+		Author: []string{
+			".article-byline .author-name",
+			".gh-article-author-name",
+			".post-full-byline-content .author-name",
+			".author-name",
+			"meta[name='author']",
+		},
+		Content:       ".gh-content, .post-full-content, .post-content, .article-content",
+		AuthorFromURL: authorFromSubdomain,
+	},
+}
+
+// buttondownSource handles newsletter archives hosted by Buttondown
+var buttondownSource = selectorSource{
+	name:  "Buttondown",
+	hosts: []string{"buttondown.com", "buttondown.email"},
+	selectors: selectorSet{
+		Title:         []string{".email-detail h1", "h1"},
+		Author:        []string{"meta[name='author']", "meta[property='og:site_name']"},
+		Content:       ".email-body-content, .email-body",
+		AuthorFromURL: authorFromFirstPathSegment,
+	},
+}
+
+// beehiivSource handles newsletters hosted by beehiiv
+var beehiivSource = selectorSource{
+	name:      "beehiiv",
+	hosts:     []string{"beehiiv.com"},
+	generator: "beehiiv",
+	assetHost: "beehiiv.com",
+	selectors: selectorSet{
+		Title:         []string{"h1"},
+		Author:        []string{"meta[name='author']", "meta[property='og:site_name']"},
+		Content:       "#content-blocks, .rendered-post",
+		AuthorFromURL: authorFromSubdomain,
+	},
+}
+
+// hostMatches reports whether the URL host is one of the domains or a subdomain of them
+func hostMatches(pageURL string, domains ...string) bool {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(parsedURL.Hostname())
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorFromFirstPathSegment uses the first path segment of the URL as the
+// author, as in buttondown.com/author/archive/post
+func authorFromFirstPathSegment(pageURL string) string {
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return strings.Split(strings.Trim(parsedURL.Path, "/"), "/")[0]
+}
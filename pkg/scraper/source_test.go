@@ -0,0 +1,292 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// articleBody is enough text for the generic extractor to find an article
+var articleBody = strings.Repeat("<p>"+strings.Repeat("This paragraph is part of a long article, with enough words to count as content. ", 5)+"</p>\n", 6)
+
+// siteServer serves one page at /post and, if api is set, Substack's archive
+// API. It counts the requests for every path.
+type siteServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newSiteServer(t *testing.T, page string, api bool) *siteServer {
+	t.Helper()
+	useTestClient(t)
+
+	s := &siteServer{requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/post":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, page)
+		case r.URL.Path == "/api/v1/archive" && api:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, "[]")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *siteServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// page returns an HTML page with the given head and an article
+func page(head string) string {
+	return "<html><head><title>Post</title>" + head + "</head><body><article><h1>Post</h1>" + articleBody + "</article></body></html>"
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		page  string
+		api   bool
+		want  string
+		probe bool
+	}{
+		{"substack markup", page(`<meta name="generator" content="Substack">`), false, "Substack", false},
+		{"substack assets", page(`<link rel="stylesheet" href="https://substackcdn.com/bundle/main.css">`), false, "Substack", false},
+		// Sites answering like Substack's API are only probed without markup
+		{"ghost markup before probe", page(`<meta name="generator" content="Ghost 5.0">`), true, "Ghost", false},
+		{"beehiiv markup before probe", page(`<meta name="generator" content="beehiiv">`), true, "beehiiv", false},
+		{"substack API", page(""), true, "Substack", true},
+		{"generic after probe", page(""), false, "Generic", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSiteServer(t, tt.page, tt.api)
+			source, doc, err := Lookup(context.Background(), server.URL+"/post")
+			if err != nil {
+				t.Fatalf("Lookup failed: %v", err)
+			}
+			if source.Name() != tt.want {
+				t.Errorf("Lookup returned %s, want %s", source.Name(), tt.want)
+			}
+			if doc == nil {
+				t.Error("Lookup did not return the downloaded page")
+			}
+			if probed := server.count("/api/v1/archive") > 0; probed != tt.probe {
+				t.Errorf("API probed: %v, want %v", probed, tt.probe)
+			}
+		})
+	}
+}
+
+func TestLookupMatchesURLWithoutDownload(t *testing.T) {
+	source, doc, err := Lookup(context.Background(), "https://example.ghost.io/post/")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if source.Name() != "Ghost" || doc != nil {
+		t.Errorf("Lookup returned %s with page %v, want Ghost without a page", source.Name(), doc)
+	}
+
+	if _, _, err := Lookup(context.Background(), "ftp://example.com/post"); err == nil {
+		t.Error("Lookup accepted an ftp URL")
+	}
+}
+
+func TestLookupNoSource(t *testing.T) {
+	server := newSiteServer(t, "<html><body><p>Hi</p></body></html>", false)
+	_, _, err := Lookup(context.Background(), server.URL+"/post")
+	if !errors.Is(err, ErrNoSource) {
+		t.Errorf("Lookup returned %v, want ErrNoSource", err)
+	}
+}
+
+func TestFetchDownloadsPageOnce(t *testing.T) {
+	for _, head := range []string{`<meta name="generator" content="Ghost 5.0">`, ""} {
+		server := newSiteServer(t, page(head), false)
+		article, err := Fetch(context.Background(), server.URL+"/post")
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if article.Title != "Post" || !strings.Contains(article.Content, "long article") {
+			t.Errorf("Fetch returned %q with content %q", article.Title, article.Content)
+		}
+		if n := server.count("/post"); n != 1 {
+			t.Errorf("page was downloaded %d times, want once", n)
+		}
+	}
+}
+
+// cookieServer is an HTTPS site that records which requests carried the
+// session cookie
+type cookieServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+// newCookieServer starts the site and logs the scraper in with the session
+// cookie SECRET. The session cookie is secure, so the site has to use TLS.
+func newCookieServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, loggedIn bool)) *cookieServer {
+	t.Helper()
+	s := &cookieServer{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(SessionCookieName)
+		loggedIn := err == nil && cookie.Value == "SECRET"
+		s.mu.Lock()
+		if loggedIn {
+			s.requests = append(s.requests, r.URL.Path+" with cookie")
+		} else {
+			s.requests = append(s.requests, r.URL.Path)
+		}
+		s.mu.Unlock()
+		handler(w, r, loggedIn)
+	}))
+	t.Cleanup(s.Close)
+
+	// The shared client is built on the default transport, which has to
+	// trust the test certificate
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = s.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+	useTestSession(t, "SECRET")
+	return s
+}
+
+// log returns the requests made so far
+func (s *cookieServer) log() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.requests, ", ")
+}
+
+func TestUnknownSiteNeverGetsSessionCookie(t *testing.T) {
+	server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		if r.URL.Path != "/post" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page(""))
+	})
+
+	for i := 0; i < 2; i++ {
+		article, err := Fetch(context.Background(), server.URL+"/post")
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if article.Title != "Post" {
+			t.Errorf("Fetch returned %q", article.Title)
+		}
+	}
+	if got := server.log(); strings.Contains(got, "cookie") {
+		t.Errorf("site got the session cookie: %s", got)
+	}
+}
+
+func TestSubstackMarkupConfirmsHost(t *testing.T) {
+	generator := `<meta name="generator" content="Substack">`
+	server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		switch {
+		case r.URL.Path != "/p/post":
+			http.NotFound(w, r)
+		case loggedIn:
+			fmt.Fprint(w, page(generator))
+		default:
+			fmt.Fprint(w, "<html><head>"+generator+`</head><body><h1>Post</h1><div class="paywall">Subscribe</div></body></html>`)
+		}
+	})
+
+	article, err := Fetch(context.Background(), server.URL+"/p/post")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if article.Truncated || !strings.Contains(article.Content, "long article") {
+		t.Errorf("Fetch returned the preview: %q", article.Content)
+	}
+	// The first download decides whether the host is Substack, so only the
+	// requests after it may carry the cookie
+	want := "/p/post, /api/v1/posts/post with cookie, /p/post with cookie"
+	if got := server.log(); got != want {
+		t.Errorf("requests were %s, want %s", got, want)
+	}
+}
+
+func TestSubstackAPIConfirmsHost(t *testing.T) {
+	server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		switch r.URL.Path {
+		case "/p/post":
+			fmt.Fprint(w, page(""))
+		case "/api/v1/archive":
+			fmt.Fprint(w, "[]")
+		case "/api/v1/posts/post":
+			body := "<p>Preview</p>"
+			if loggedIn {
+				body = articleBody
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": 1, "title": "Post", "slug": "post", "audience": "only_paid",
+				"body_html": body, "truncated_body_text": "Preview",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	article, err := Fetch(context.Background(), server.URL+"/p/post")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if article.Truncated || !strings.Contains(article.Content, "long article") {
+		t.Errorf("Fetch returned the preview: %q", article.Content)
+	}
+	want := "/p/post, /api/v1/archive, /api/v1/posts/post with cookie"
+	if got := server.log(); got != want {
+		t.Errorf("requests were %s, want %s", got, want)
+	}
+}
+
+func TestPostAPIConfirmsHost(t *testing.T) {
+	server := newCookieServer(t, func(w http.ResponseWriter, r *http.Request, loggedIn bool) {
+		if r.URL.Path != "/api/v1/posts/post" {
+			http.NotFound(w, r)
+			return
+		}
+		body := "<p>Preview</p>"
+		if loggedIn {
+			body = articleBody
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": 1, "title": "Post", "slug": "post", "audience": "only_paid",
+			"body_html": body, "truncated_body_text": "Preview",
+		})
+	})
+
+	// Posts of a crawled archive go straight to the API
+	article, err := ScrapeSubstack(context.Background(), server.URL+"/p/post")
+	if err != nil {
+		t.Fatalf("ScrapeSubstack failed: %v", err)
+	}
+	if article.Truncated {
+		t.Error("ScrapeSubstack returned the preview")
+	}
+	want := "/api/v1/posts/post, /api/v1/posts/post with cookie"
+	if got := server.log(); got != want {
+		t.Errorf("requests were %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,398 @@
+// Package smtpserver receives forwarded newsletters over SMTP and queues
+// them for conversion, so a forwarding rule can deliver them to Kindle
+package smtpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"substack-to-kindle/pkg/allowlist"
+	"substack-to-kindle/pkg/scraper"
+)
+
+// DefaultMaxMessageSize is the default limit of a message in bytes
+const DefaultMaxMessageSize = 25 << 20
+
+// DefaultAddr is the default address to listen on. It only accepts
+// connections from the same machine, since anyone who can connect can forge
+// an allowed envelope sender.
+const DefaultAddr = "127.0.0.1:2525"
+
+// commandTimeout is how long a client may take for a command or the message data
+const commandTimeout = 5 * time.Minute
+
+// pathArgument matches the address and parameters of MAIL FROM and RCPT TO
+var pathArgument = regexp.MustCompile(`(?i)^(?:FROM|TO):\s*<([^>]*)>\s*(.*)$`)
+
+// Config contains the address the server listens on and who may send to it
+type Config struct {
+	// Addr is the address to listen on, e.g. "127.0.0.1:2525"; ":2525"
+	// listens on all interfaces
+	Addr string
+	// Hostname is the name the server greets clients with
+	Hostname string
+	// AllowedSenders are the envelope senders whose mail is accepted
+	AllowedSenders allowlist.List
+	// MaxMessageSize is the largest message accepted, in bytes
+	MaxMessageSize int64
+	// TLSConfig enables STARTTLS if set
+	TLSConfig *tls.Config
+	// QueueSize is how many messages may wait for conversion; when the queue
+	// is full, senders are asked to try again later
+	QueueSize int
+}
+
+// LoadConfigFromEnv loads the server configuration from environment
+// variables, with STARTTLS if a certificate and key are given
+func LoadConfigFromEnv() (Config, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	config := Config{
+		Addr:           envOr("SMTP_SERVER_ADDR", DefaultAddr),
+		Hostname:       envOr("SMTP_SERVER_HOSTNAME", hostname),
+		AllowedSenders: allowlist.Parse(os.Getenv("SMTP_SERVER_ALLOWED_SENDERS")),
+		MaxMessageSize: DefaultMaxMessageSize,
+		QueueSize:      100,
+	}
+
+	certFile, keyFile := os.Getenv("SMTP_SERVER_TLS_CERT"), os.Getenv("SMTP_SERVER_TLS_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return config, nil
+}
+
+// envOr returns an environment variable, or fallback if it is not set
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Handler converts and sends an article read from a received message
+type Handler func(ctx context.Context, article *scraper.Article) error
+
+// Server accepts mail from allowed senders and hands the newsletters in it
+// to a handler, one at a time
+type Server struct {
+	config  Config
+	handler Handler
+	queue   chan *scraper.Article
+}
+
+// New creates a server for the config
+func New(config Config, handler Handler) (*Server, error) {
+	if len(config.AllowedSenders) == 0 {
+		return nil, fmt.Errorf("no allowed senders configured, set SMTP_SERVER_ALLOWED_SENDERS")
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.Addr == "" {
+		config.Addr = DefaultAddr
+	}
+	if config.Hostname == "" {
+		config.Hostname = "localhost"
+	}
+	return &Server{
+		config:  config,
+		handler: handler,
+		queue:   make(chan *scraper.Article, config.QueueSize),
+	}, nil
+}
+
+// ListenAndServe accepts connections until the context is cancelled. The
+// messages already accepted are still converted before it returns, since
+// their senders were told they were delivered.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Addr, err)
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on a listener until the context is cancelled
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	// Convert and send one message at a time
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for article := range s.queue {
+			if err := s.handler(context.WithoutCancel(ctx), article); err != nil {
+				log.Printf("Warning: Failed to process %q: %v", article.Title, err)
+			}
+		}
+	}()
+
+	var sessions sync.WaitGroup
+	var serveErr error
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			// Wait out running out of file descriptors or buffers and
+			// connections reset before they were accepted, instead of giving up
+			if temporaryAcceptError(err) {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				log.Printf("Warning: Failed to accept connection, retrying in %v: %v", delay, err)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			serveErr = fmt.Errorf("failed to accept connection: %w", err)
+			break
+		}
+		delay = 0
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+
+	// Let open sessions finish, then work off the queue
+	sessions.Wait()
+	close(s.queue)
+	if pending := len(s.queue); pending > 0 {
+		log.Printf("Finishing %d queued newsletters...", pending)
+	}
+	<-done
+
+	if serveErr != nil {
+		return serveErr
+	}
+	return ctx.Err()
+}
+
+// session is the state of one SMTP conversation
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+	tls    bool
+	// from and recipients are the envelope of the current message
+	from       string
+	recipients int
+}
+
+// serveConn runs an SMTP conversation (RFC 5321) until the client quits
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	// Cancellation closes the connection, ending the session
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	ss := &session{server: s, conn: conn, text: textproto.NewConn(conn)}
+	defer func() { ss.text.Close() }()
+
+	ss.reply(220, "%s ESMTP substack-to-kindle", s.config.Hostname)
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := ss.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, argument, _ := strings.Cut(line, " ")
+		if !ss.handle(strings.ToUpper(verb), strings.TrimSpace(argument)) {
+			return
+		}
+	}
+}
+
+// handle answers one command and reports whether the session goes on
+func (ss *session) handle(verb, argument string) bool {
+	config := &ss.server.config
+	switch verb {
+	case "HELO":
+		ss.reset()
+		ss.reply(250, "%s", config.Hostname)
+	case "EHLO":
+		ss.reset()
+		extensions := []string{config.Hostname, "8BITMIME", fmt.Sprintf("SIZE %d", config.MaxMessageSize)}
+		if config.TLSConfig != nil && !ss.tls {
+			extensions = append(extensions, "STARTTLS")
+		}
+		ss.reply(250, "%s", strings.Join(extensions, "\n"))
+	case "STARTTLS":
+		if config.TLSConfig == nil || ss.tls {
+			ss.reply(502, "5.5.1 TLS not available")
+			return true
+		}
+		ss.reply(220, "2.0.0 Ready to start TLS")
+		tlsConn := tls.Server(ss.conn, config.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		ss.conn = tlsConn
+		ss.text = textproto.NewConn(tlsConn)
+		ss.tls = true
+		ss.reset()
+	case "MAIL":
+		ss.mail(argument)
+	case "RCPT":
+		if ss.from == "" {
+			ss.reply(503, "5.5.1 Send MAIL first")
+			return true
+		}
+		if pathArgument.FindStringSubmatch(argument) == nil {
+			ss.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+			return true
+		}
+		ss.recipients++
+		ss.reply(250, "2.1.5 OK")
+	case "DATA":
+		if ss.recipients == 0 {
+			ss.reply(503, "5.5.1 Send RCPT first")
+			return true
+		}
+		return ss.data()
+	case "RSET":
+		ss.reset()
+		ss.reply(250, "2.0.0 OK")
+	case "NOOP":
+		ss.reply(250, "2.0.0 OK")
+	case "VRFY":
+		ss.reply(252, "2.5.0 Cannot verify users")
+	case "QUIT":
+		ss.reply(221, "2.0.0 Bye")
+		return false
+	default:
+		ss.reply(502, "5.5.2 Command not recognized")
+	}
+	return true
+}
+
+// mail starts a message after checking the envelope sender against the allow list
+func (ss *session) mail(argument string) {
+	match := pathArgument.FindStringSubmatch(argument)
+	if match == nil || !strings.HasPrefix(strings.ToUpper(argument), "FROM:") {
+		ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	// Bounces have no sender and are never newsletters
+	address, err := mail.ParseAddress(match[1])
+	if err != nil || !ss.server.config.AllowedSenders.Allows(address.Address) {
+		log.Printf("Refusing mail from <%s>, who is not an allowed sender", match[1])
+		ss.reply(550, "5.7.1 Sender not allowed")
+		return
+	}
+
+	for _, parameter := range strings.Fields(match[2]) {
+		var size int64
+		if _, err := fmt.Sscanf(strings.ToUpper(parameter), "SIZE=%d", &size); err == nil && size > ss.server.config.MaxMessageSize {
+			ss.reply(552, "5.3.4 Message too big")
+			return
+		}
+	}
+
+	ss.reset()
+	ss.from = address.Address
+	ss.reply(250, "2.1.0 OK")
+}
+
+// data reads a message, turns it into an article and queues it. It reports
+// whether the session goes on.
+func (ss *session) data() bool {
+	ss.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	ss.conn.SetDeadline(time.Now().Add(commandTimeout))
+	limit := ss.server.config.MaxMessageSize
+	dot := ss.text.DotReader()
+	message, err := io.ReadAll(io.LimitReader(dot, limit+1))
+	if err != nil {
+		return false
+	}
+	from := ss.from
+	ss.reset()
+
+	if int64(len(message)) > limit {
+		// Skip the rest of the message before answering
+		if _, err := io.Copy(io.Discard, dot); err != nil {
+			return false
+		}
+		ss.reply(552, "5.3.4 Message too big")
+		return true
+	}
+
+	article, err := scraper.ScrapeEmail(message)
+	if err != nil {
+		log.Printf("Warning: Failed to read message from <%s>: %v", from, err)
+		ss.reply(554, "5.6.0 Message could not be read")
+		return true
+	}
+
+	select {
+	case ss.server.queue <- article:
+		log.Printf("Queued %q from <%s>", article.Title, from)
+		ss.reply(250, "2.0.0 Queued")
+	default:
+		ss.reply(451, "4.3.1 Queue full, try again later")
+	}
+	return true
+}
+
+// reset forgets the envelope of the current message
+func (ss *session) reset() {
+	ss.from = ""
+	ss.recipients = 0
+}
+
+// reply sends a reply; the lines of a multi-line text become a multi-line reply
+func (ss *session) reply(code int, format string, args ...interface{}) {
+	lines := strings.Split(fmt.Sprintf(format, args...), "\n")
+	w := bufio.NewWriter(ss.conn)
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(w, "%d%s%s\r\n", code, separator, line)
+	}
+	if err := w.Flush(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Warning: Failed to reply to SMTP client: %v", err)
+	}
+}
+
+// temporaryAcceptError reports whether Accept failed for a reason that passes
+// by itself, so the server should try again
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
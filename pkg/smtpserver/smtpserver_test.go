@@ -0,0 +1,370 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"substack-to-kindle/pkg/allowlist"
+	"substack-to-kindle/pkg/scraper"
+)
+
+// testMessage is a newsletter as a forwarding rule would deliver it
+const testMessage = "From: Jane Doe <jane@example.org>\r\n" +
+	"Subject: %s\r\n" +
+	"Date: Mon, 1 Apr 2024 08:00:00 +0000\r\n" +
+	"Message-ID: <%s@example.org>\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello readers.\r\n" +
+	"\r\n" +
+	"This is the newsletter.\r\n"
+
+// testServer is a server running on a loopback listener
+type testServer struct {
+	addr   string
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// startServer runs a server until the test ends or stop is called
+func startServer(t *testing.T, config Config, handler Handler) *testServer {
+	t.Helper()
+	if config.AllowedSenders == nil {
+		config.AllowedSenders = allowlist.Parse("example.org")
+	}
+	server, err := New(config, handler)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &testServer{addr: listener.Addr().String(), cancel: cancel, done: make(chan error, 1)}
+	go func() { s.done <- server.Serve(ctx, listener) }()
+	t.Cleanup(func() { s.stop(t) })
+	return s
+}
+
+// stop shuts the server down and returns the error Serve returned
+func (s *testServer) stop(t *testing.T) error {
+	t.Helper()
+	s.cancel()
+	select {
+	case err := <-s.done:
+		s.done <- err
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not shut down")
+		return nil
+	}
+}
+
+// smtpClient is a client that checks reply codes
+type smtpClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+// dial connects to the server and reads its greeting
+func (s *testServer) dial(t *testing.T) *smtpClient {
+	t.Helper()
+	text, err := textproto.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { text.Close() })
+	c := &smtpClient{t: t, text: text}
+	c.expect(220)
+	c.cmd(250, "EHLO client.example")
+	return c
+}
+
+// cmd sends a command and checks the reply code; it returns the reply text
+func (c *smtpClient) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		c.t.Fatalf("failed to send %q: %v", format, err)
+	}
+	return c.expect(code)
+}
+
+// expect reads a reply and checks its code
+func (c *smtpClient) expect(code int) string {
+	c.t.Helper()
+	got, message, err := c.text.ReadResponse(0)
+	if err != nil && !errors.As(err, new(*textproto.Error)) {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	if got != code {
+		c.t.Fatalf("got reply %d %s, want %d", got, message, code)
+	}
+	return message
+}
+
+// send delivers a message and returns the reply code to the data
+func (c *smtpClient) send(from, subject string) int {
+	c.t.Helper()
+	c.cmd(250, "MAIL FROM:<%s>", from)
+	c.cmd(250, "RCPT TO:<kindle@example.net>")
+	c.cmd(354, "DATA")
+	w := c.text.DotWriter()
+	fmt.Fprintf(w, testMessage, subject, strings.ReplaceAll(subject, " ", "-"))
+	if err := w.Close(); err != nil {
+		c.t.Fatalf("failed to send data: %v", err)
+	}
+	code, _, err := c.text.ReadResponse(0)
+	if err != nil && !errors.As(err, new(*textproto.Error)) {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	return code
+}
+
+// collector is a handler that records the titles of the articles it gets,
+// optionally waiting for release before it returns
+type collector struct {
+	mu      sync.Mutex
+	titles  []string
+	started chan string
+	release chan struct{}
+}
+
+func (c *collector) handle(ctx context.Context, article *scraper.Article) error {
+	if c.started != nil {
+		c.started <- article.Title
+	}
+	if c.release != nil {
+		<-c.release
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.titles = append(c.titles, article.Title)
+	return nil
+}
+
+func (c *collector) handled() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.titles...)
+}
+
+func TestServerAcceptsAllowedSenders(t *testing.T) {
+	handler := &collector{started: make(chan string, 1)}
+	server := startServer(t, Config{}, handler.handle)
+
+	c := server.dial(t)
+	if code := c.send("jane@example.org", "Issue 1"); code != 250 {
+		t.Fatalf("message got reply %d, want 250", code)
+	}
+	select {
+	case title := <-handler.started:
+		if title != "Issue 1" {
+			t.Errorf("handler got %q, want the subject", title)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	c.cmd(221, "QUIT")
+}
+
+func TestServerRefusesSenders(t *testing.T) {
+	handler := &collector{}
+	server := startServer(t, Config{AllowedSenders: allowlist.Parse("substack.com, jane@example.org")}, handler.handle)
+	c := server.dial(t)
+
+	for _, from := range []string{
+		"john@example.org",
+		"jane@example.org.evil.example",
+		"news@notsubstack.com",
+		"", // bounces
+		"not an address",
+	} {
+		c.cmd(550, "MAIL FROM:<%s>", from)
+	}
+	// Nothing was started, so there is nothing to send to
+	c.cmd(503, "RCPT TO:<kindle@example.net>")
+
+	c.cmd(250, "MAIL FROM:<writer@mail.substack.com>")
+	c.cmd(250, "RSET")
+	c.cmd(501, "MAIL jane@example.org")
+
+	if err := server.stop(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve returned %v, want context.Canceled", err)
+	}
+	if titles := handler.handled(); len(titles) != 0 {
+		t.Errorf("handler got %q from refused senders", titles)
+	}
+}
+
+func TestServerSizeLimit(t *testing.T) {
+	handler := &collector{}
+	server := startServer(t, Config{MaxMessageSize: 200}, handler.handle)
+	c := server.dial(t)
+
+	if ehlo := c.cmd(250, "EHLO client.example"); !strings.Contains(ehlo, "SIZE 200") {
+		t.Errorf("EHLO reply %q does not announce the size limit", ehlo)
+	}
+
+	// A declared size over the limit is refused up front
+	c.cmd(552, "MAIL FROM:<jane@example.org> SIZE=201")
+	c.cmd(250, "MAIL FROM:<jane@example.org> SIZE=200")
+	c.cmd(250, "RSET")
+
+	// A message that turns out to be too big is refused after its data, and
+	// the session goes on
+	if code := c.send("jane@example.org", strings.Repeat("Long subject ", 20)); code != 552 {
+		t.Errorf("oversized message got reply %d, want 552", code)
+	}
+	c.cmd(250, "NOOP")
+
+	server.stop(t)
+	if titles := handler.handled(); len(titles) != 0 {
+		t.Errorf("handler got oversized messages %q", titles)
+	}
+}
+
+func TestServerQueueFull(t *testing.T) {
+	handler := &collector{started: make(chan string, 10), release: make(chan struct{})}
+	server := startServer(t, Config{QueueSize: 1}, handler.handle)
+	c := server.dial(t)
+
+	// The first message keeps the handler busy and the second fills the queue
+	if code := c.send("jane@example.org", "First"); code != 250 {
+		t.Fatalf("first message got reply %d, want 250", code)
+	}
+	<-handler.started
+	if code := c.send("jane@example.org", "Second"); code != 250 {
+		t.Fatalf("second message got reply %d, want 250", code)
+	}
+	if code := c.send("jane@example.org", "Third"); code != 451 {
+		t.Errorf("message to a full queue got reply %d, want 451", code)
+	}
+
+	close(handler.release)
+	server.stop(t)
+	if titles := handler.handled(); strings.Join(titles, ", ") != "First, Second" {
+		t.Errorf("handler got %q, want the two accepted messages", titles)
+	}
+}
+
+func TestServerDrainsQueueOnShutdown(t *testing.T) {
+	handler := &collector{started: make(chan string, 10), release: make(chan struct{})}
+	server := startServer(t, Config{QueueSize: 10}, handler.handle)
+	c := server.dial(t)
+
+	for i := 1; i <= 3; i++ {
+		if code := c.send("jane@example.org", fmt.Sprintf("Issue %d", i)); code != 250 {
+			t.Fatalf("message %d got reply %d, want 250", i, code)
+		}
+	}
+	<-handler.started
+
+	// Shutting down closes the connection, but waits for the queue
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.stop(t) }()
+	select {
+	case <-stopped:
+		t.Fatal("server shut down before the queue was finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(handler.release)
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve returned %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if titles := handler.handled(); strings.Join(titles, ", ") != "Issue 1, Issue 2, Issue 3" {
+		t.Errorf("handler got %q, want all queued messages", titles)
+	}
+	if _, err := net.DialTimeout("tcp", server.addr, time.Second); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+// flakyListener fails its first Accept calls with a temporary error, like a
+// process that ran out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerRetriesTemporaryAcceptErrors(t *testing.T) {
+	handler := &collector{}
+	server, err := New(Config{AllowedSenders: allowlist.Parse("example.org")}, handler.handle)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, &flakyListener{Listener: listener, failures: 3}) }()
+
+	s := &testServer{addr: listener.Addr().String(), cancel: cancel, done: done}
+	c := s.dial(t)
+	c.cmd(221, "QUIT")
+
+	if err := s.stop(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve returned %v, want context.Canceled", err)
+	}
+}
+
+func TestServerStopsOnPermanentAcceptErrors(t *testing.T) {
+	server, err := New(Config{AllowedSenders: allowlist.Parse("example.org")}, (&collector{}).handle)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	listener.Close()
+
+	if err := server.Serve(context.Background(), listener); err == nil || errors.Is(err, context.Canceled) {
+		t.Errorf("Serve returned %v, want the accept error", err)
+	}
+}
+
+func TestTemporaryAcceptError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}, true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.ENFILE)}, true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.ECONNABORTED}, true},
+		{net.ErrClosed, false},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EBADF}, false},
+		{errors.New("accept failed"), false},
+	} {
+		if got := temporaryAcceptError(tt.err); got != tt.want {
+			t.Errorf("temporaryAcceptError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}